@@ -0,0 +1,67 @@
+package rest
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// Account identity returned by the REST API, see Client.SameAccount
+//
+type accountInfo struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+//
+// Query the identity of the account the client is authenticated as
+//
+func (c *Client) accountInfo(opts ...Option) (*accountInfo, error) {
+	var url = fmt.Sprintf("%s/users/%s", c.BaseURL, c.Username)
+
+	var info accountInfo
+	if err := c.executeRequest("GET", url, nil, &info, opts...); err != nil {
+		return nil, fmt.Errorf(
+			"couldn't get the account of %s at %s: %w",
+			c.Username, c.BaseURL, err)
+	}
+	if info.Id == "" && info.Username == "" {
+		return nil, fmt.Errorf(
+			"couldn't get the account of %s at %s: no account in response",
+			c.Username, c.BaseURL)
+	}
+
+	return &info, nil
+}
+
+//
+// Report whether the client and `other` manage the tunnels of the same
+// account: their credentials authenticate the same account, according to the
+// REST API, in the same region. Fail if either account can't be queried.
+//
+func (c *Client) SameAccount(other *Client, opts ...Option) (bool, error) {
+	mine, err := c.accountInfo(opts...)
+	if err != nil {
+		return false, err
+	}
+	theirs, err := other.accountInfo(opts...)
+	if err != nil {
+		return false, err
+	}
+
+	var region, _ = RegionFromBaseURL(c.BaseURL)
+	var otherRegion, _ = RegionFromBaseURL(other.BaseURL)
+	if region == "" && otherRegion == "" {
+		// Unknown hosts, for example a proxy, compare the URLs instead
+		region = Region(strings.TrimSuffix(c.BaseURL, "/"))
+		otherRegion = Region(strings.TrimSuffix(other.BaseURL, "/"))
+	}
+	if region != otherRegion {
+		return false, nil
+	}
+
+	if mine.Id != "" || theirs.Id != "" {
+		return mine.Id == theirs.Id, nil
+	}
+	return strings.EqualFold(mine.Username, theirs.Username), nil
+}
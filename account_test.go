@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestClientSameAccount(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch path.Base(r.URL.Path) {
+			case "john", "john-ci":
+				io.WriteString(w, `{"id": "1234", "username": "john"}`)
+			case "jane":
+				io.WriteString(w, `{"id": "5678", "username": "jane"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+
+	var client = func(username string) *Client {
+		return &Client{
+			BaseURL:  server.URL,
+			Username: username,
+			Password: "password",
+		}
+	}
+
+	var tests = []struct {
+		a, b string
+		same bool
+		fail bool
+	}{
+		{"john", "john-ci", true, false},
+		{"john", "jane", false, false},
+		{"john", "unknown", false, true},
+	}
+
+	for _, test := range tests {
+		same, err := client(test.a).SameAccount(client(test.b))
+		if same != test.same || (err != nil) != test.fail {
+			t.Errorf("SameAccount(%s, %s) = %v, %v",
+				test.a, test.b, same, err)
+		}
+	}
+
+	var other = client("john")
+	other.BaseURL = RegionEUCentral1.BaseURL()
+	other.Client = http.Client{Transport: redirectTransport{server}}
+	if same, err := client("john").SameAccount(other); same || err != nil {
+		t.Errorf("SameAccount across regions = %v, %v", same, err)
+	}
+}
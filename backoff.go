@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"time"
+)
+
+//
+// Policy for the delay between two status queries while waiting for a tunnel,
+// see Client.Backoff and WithBackoff. `attempt` is 0 before the second query,
+// 1 before the third, and so on.
+//
+type Backoff interface {
+	NextInterval(attempt int) time.Duration
+}
+
+//
+// Wait the same delay between all queries
+//
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) NextInterval(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+//
+// Wait Initial, then Step longer after each query, up to Max if it's not
+// zero
+//
+type LinearBackoff struct {
+	Initial time.Duration
+	Step    time.Duration
+	Max     time.Duration
+}
+
+func (b LinearBackoff) NextInterval(attempt int) time.Duration {
+	return capInterval(b.Initial+time.Duration(attempt)*b.Step, b.Max)
+}
+
+//
+// Wait Initial, then multiply the delay by Factor after each query, up to Max
+// if it's not zero. Factor defaults to 2.
+//
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Factor  float64
+	Max     time.Duration
+}
+
+func (b ExponentialBackoff) NextInterval(attempt int) time.Duration {
+	var factor = b.Factor
+	if factor == 0 {
+		factor = 2
+	}
+
+	var interval = float64(b.Initial)
+	for i := 0; i < attempt; i++ {
+		interval *= factor
+		if b.Max > 0 && interval >= float64(b.Max) {
+			return b.Max
+		}
+	}
+	return capInterval(time.Duration(interval), b.Max)
+}
+
+func capInterval(interval, max time.Duration) time.Duration {
+	if max > 0 && interval > max {
+		return max
+	}
+	return interval
+}
+
+//
+// Return the polling policy of a call: the one passed with WithBackoff, then
+// Client.Backoff, then a constant Client.PollInterval. A policy returning a
+// delay <= 0, like a zero-valued one, waits Client.PollInterval instead of
+// querying the REST API in a busy loop.
+//
+func (c *Client) backoff(opts ...Option) Backoff {
+	var o callOptions
+	for _, option := range opts {
+		option(&o)
+	}
+
+	switch {
+	case o.backoff != nil:
+		return minBackoff{o.backoff, c.pollInterval()}
+	case c.Backoff != nil:
+		return minBackoff{c.Backoff, c.pollInterval()}
+	default:
+		return ConstantBackoff(c.pollInterval())
+	}
+}
+
+//
+// Backoff waiting `fallback` when `backoff` returns a delay <= 0
+//
+type minBackoff struct {
+	backoff  Backoff
+	fallback time.Duration
+}
+
+func (b minBackoff) NextInterval(attempt int) time.Duration {
+	if interval := b.backoff.NextInterval(attempt); interval > 0 {
+		return interval
+	}
+	return b.fallback
+}
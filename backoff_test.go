@@ -0,0 +1,94 @@
+package rest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNextInterval(t *testing.T) {
+	var tests = []struct {
+		backoff  Backoff
+		expected []time.Duration
+	}{
+		{
+			ConstantBackoff(time.Second),
+			[]time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			LinearBackoff{Initial: time.Second, Step: 2 * time.Second,
+				Max: 4 * time.Second},
+			[]time.Duration{time.Second, 3 * time.Second, 4 * time.Second},
+		},
+		{
+			ExponentialBackoff{Initial: time.Second, Max: 3 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			ExponentialBackoff{Initial: time.Second, Factor: 3},
+			[]time.Duration{time.Second, 3 * time.Second, 9 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		for attempt, expected := range test.expected {
+			var interval = test.backoff.NextInterval(attempt)
+			if interval != expected {
+				t.Errorf("%+v: invalid interval %d: %s, expected %s",
+					test.backoff, attempt, interval, expected)
+			}
+		}
+	}
+}
+
+func TestClientWaitForStatusBackoff(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "booting", "id": "fakeid"}`),
+		stringResponse(`{"status": "booting", "id": "fakeid"}`),
+		stringResponse(`{"status": "running", "id": "fakeid"}`),
+	})
+	defer server.Close()
+
+	var clock = &fakeClock{}
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Backoff:  ConstantBackoff(time.Minute),
+		clock:    clock,
+	}
+
+	_, err := client.WaitForStatus("fakeid", "running", time.Hour,
+		WithBackoff(ExponentialBackoff{Initial: time.Second}))
+	if err != nil {
+		t.Errorf("client.WaitForStatus errored %+v\n", err)
+	}
+	if elapsed := clock.now.Sub(time.Time{}); elapsed != 3*time.Second {
+		t.Errorf("Invalid time spent waiting: %s", elapsed)
+	}
+}
+
+func TestClientWaitForStatusZeroBackoff(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "booting", "id": "fakeid"}`),
+		stringResponse(`{"status": "running", "id": "fakeid"}`),
+	})
+	defer server.Close()
+
+	var clock = &fakeClock{}
+	var client = Client{
+		BaseURL:      server.URL,
+		Username:     "username",
+		Password:     "password",
+		Backoff:      ExponentialBackoff{},
+		PollInterval: 5 * time.Second,
+		clock:        clock,
+	}
+
+	_, err := client.WaitForStatus("fakeid", "running", time.Hour)
+	if err != nil {
+		t.Errorf("client.WaitForStatus errored %+v\n", err)
+	}
+	if elapsed := clock.now.Sub(time.Time{}); elapsed != 5*time.Second {
+		t.Errorf("Invalid time spent waiting: %s", elapsed)
+	}
+}
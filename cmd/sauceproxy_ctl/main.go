@@ -38,6 +38,7 @@ type CreateOptions struct {
 	VmVersion        string        `long:"vm-version" value-name:"<version>" description:"Request a specific tunnel VM version."`
 	NoSslBumpDomains []string      `short:"B" long:"no-ssl-bump-domains" value-name:"<...>" description:"Comma-separated list of domains. Requests whose host matches one of these will not be SSL re-encrypted."`
 	Timeout          time.Duration `long:"timeout" description:"Timeout (example: 10, 10s 1m, or 1h)"`
+	AllowNoDomains   bool          `long:"allow-no-domains" description:"Create the tunnel without -t. Jobs without a tunnel identifier may then send all their traffic through it."`
 }
 
 //
@@ -176,6 +177,7 @@ func main() {
 				VMVersion:        options.VmVersion,
 				NoSSLBumpDomains: options.NoSslBumpDomains,
 				Metadata:         metadata,
+				AllowNoDomains:   options.AllowNoDomains,
 			},
 			timeout,
 		)
@@ -0,0 +1,209 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Base URL of the REST API used when the configuration doesn't set one
+const DefaultBaseURL = "https://saucelabs.com/rest/v1"
+
+//
+// Return a client configured with the credentials file at `path`, usually
+// ~/.sauce/credentials.yml. It's the YAML file written by saucectl:
+//
+//	username: john
+//	accessKey: 0123-4567
+//
+// An optional `restURL` key overrides DefaultBaseURL. Only top-level
+// `key: value` pairs are supported, other keys are ignored. Indented lines,
+// the content of nested mappings, are skipped, and a ` #` comment ends an
+// unquoted value.
+//
+// The environment variables SAUCE_USERNAME and SAUCE_ACCESS_KEY override the
+// values of the file.
+//
+func NewClientFromConfigFile(path string) (*Client, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read credentials: %s", err)
+	}
+	defer file.Close()
+
+	var values = make(map[string]string)
+	var scanner = bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var raw = scanner.Text()
+		if strings.HasPrefix(raw, " ") || strings.HasPrefix(raw, "\t") {
+			continue
+		}
+
+		var text = strings.TrimSpace(raw)
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf(
+				"invalid credentials file %s, line %d: %q",
+				path, line, text)
+		}
+		values[strings.TrimSpace(key)] = scalar(strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read credentials: %s", err)
+	}
+
+	if env := os.Getenv("SAUCE_USERNAME"); env != "" {
+		values["username"] = env
+	}
+	if env := os.Getenv("SAUCE_ACCESS_KEY"); env != "" {
+		values["accessKey"] = env
+	}
+
+	for _, key := range []string{"username", "accessKey"} {
+		if values[key] == "" {
+			return nil, fmt.Errorf(
+				"invalid credentials file %s: missing %s", path, key)
+		}
+	}
+
+	var client = Client{
+		BaseURL:  DefaultBaseURL,
+		Username: values["username"],
+		Password: values["accessKey"],
+	}
+	if values["restURL"] != "" {
+		client.BaseURL = values["restURL"]
+	}
+
+	return &client, nil
+}
+
+//
+// Return the value of a YAML scalar: without its quotes, or without its
+// trailing comment if it isn't quoted
+//
+func scalar(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			return value[1 : end+1]
+		}
+		return value
+	}
+
+	if strings.HasPrefix(value, "#") {
+		return ""
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+//
+// Declarative definition of a tunnel, for example loaded from a YAML or JSON
+// file. Convert it with ToRequest. The keys follow the REST API's where
+// there's one, except kgp_port, sent as ssh_port, and labels, sent in the
+// metadata. no_wait, allow_no_domains, unique_identifier and region_hint
+// only configure the client, see Request. The struct tags are the only YAML
+// support: decode the file with any YAML library honoring `yaml` tags.
+//
+//	tunnel_identifier: web
+//	domain_names: ["*.example.com"]
+//	labels:
+//	  team: frontend
+//	extra_info:
+//	  inject_job_id: true
+//
+type TunnelConfig struct {
+	TunnelIdentifier string   `json:"tunnel_identifier" yaml:"tunnel_identifier"`
+	DomainNames      []string `json:"domain_names" yaml:"domain_names"`
+
+	DirectDomains    []string `json:"direct_domains" yaml:"direct_domains"`
+	KGPPort          int      `json:"kgp_port" yaml:"kgp_port"`
+	NoProxyCaching   bool     `json:"no_proxy_caching" yaml:"no_proxy_caching"`
+	FastFailRegexps  []string `json:"fast_fail_regexps" yaml:"fast_fail_regexps"`
+	SharedTunnel     bool     `json:"shared_tunnel" yaml:"shared_tunnel"`
+	VMVersion        string   `json:"vm_version" yaml:"vm_version"`
+	NoSSLBumpDomains []string `json:"no_ssl_bump_domains" yaml:"no_ssl_bump_domains"`
+	UseKGP           *bool    `json:"use_kgp" yaml:"use_kgp"`
+
+	Metadata Metadata          `json:"metadata" yaml:"metadata"`
+	Labels   map[string]string `json:"labels" yaml:"labels"`
+
+	NoWait           bool   `json:"no_wait" yaml:"no_wait"`
+	AllowNoDomains   bool   `json:"allow_no_domains" yaml:"allow_no_domains"`
+	UniqueIdentifier bool   `json:"unique_identifier" yaml:"unique_identifier"`
+	RegionHint       string `json:"region_hint" yaml:"region_hint"`
+
+	// Sent as Request.ExtraInfo, encoded as a JSON object
+	ExtraInfo map[string]interface{} `json:"extra_info" yaml:"extra_info"`
+}
+
+//
+// Decode the config like encoding/json, except that the numbers of ExtraInfo
+// are json.Number rather than float64, so large integers are sent exactly.
+//
+func (c *TunnelConfig) UnmarshalJSON(data []byte) error {
+	type plainConfig TunnelConfig
+	var v struct {
+		*plainConfig
+		ExtraInfo json.RawMessage `json:"extra_info"`
+	}
+	v.plainConfig = (*plainConfig)(c)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	c.ExtraInfo = nil
+	if len(v.ExtraInfo) == 0 {
+		return nil
+	}
+	var decoder = json.NewDecoder(bytes.NewReader(v.ExtraInfo))
+	decoder.UseNumber()
+	return decoder.Decode(&c.ExtraInfo)
+}
+
+//
+// Return the request creating the tunnel described by `c`, and fail if it
+// isn't valid, see Request.Validate.
+//
+func (c TunnelConfig) ToRequest() (*Request, error) {
+	var request = Request{
+		TunnelIdentifier: c.TunnelIdentifier,
+		DomainNames:      c.DomainNames,
+		DirectDomains:    c.DirectDomains,
+		KGPPort:          c.KGPPort,
+		NoProxyCaching:   c.NoProxyCaching,
+		FastFailRegexps:  c.FastFailRegexps,
+		SharedTunnel:     c.SharedTunnel,
+		VMVersion:        c.VMVersion,
+		NoSSLBumpDomains: c.NoSSLBumpDomains,
+		UseKGP:           c.UseKGP,
+		Metadata:         c.Metadata,
+		Labels:           c.Labels,
+		NoWait:           c.NoWait,
+		AllowNoDomains:   c.AllowNoDomains,
+		UniqueIdentifier: c.UniqueIdentifier,
+		RegionHint:       c.RegionHint,
+	}
+
+	if len(c.ExtraInfo) > 0 {
+		extraInfo, err := json.Marshal(c.ExtraInfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra_info: %w", err)
+		}
+		request.ExtraInfo = string(extraInfo)
+	}
+
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
@@ -0,0 +1,146 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	var path = filepath.Join(t.TempDir(), "credentials.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("os.WriteFile errored %+v\n", err)
+	}
+	return path
+}
+
+func TestNewClientFromConfigFile(t *testing.T) {
+	t.Setenv("SAUCE_USERNAME", "")
+	t.Setenv("SAUCE_ACCESS_KEY", "")
+
+	var path = writeConfigFile(t, `# saucectl credentials
+username: john
+accessKey: "0123-4567"
+`)
+
+	client, err := NewClientFromConfigFile(path)
+	if err != nil {
+		t.Fatalf("NewClientFromConfigFile errored %+v\n", err)
+	}
+	if client.Username != "john" || client.Password != "0123-4567" ||
+		client.BaseURL != DefaultBaseURL {
+		t.Errorf("Invalid client: %+v\n", client)
+	}
+}
+
+func TestNewClientFromConfigFileNested(t *testing.T) {
+	t.Setenv("SAUCE_USERNAME", "")
+	t.Setenv("SAUCE_ACCESS_KEY", "")
+
+	var path = writeConfigFile(t, `username: john # the CI account
+accessKey: '0123#4567' # quoted
+proxy:
+  username: proxy-user
+	restURL: https://proxy.example.com
+`)
+
+	client, err := NewClientFromConfigFile(path)
+	if err != nil {
+		t.Fatalf("NewClientFromConfigFile errored %+v\n", err)
+	}
+	if client.Username != "john" || client.Password != "0123#4567" ||
+		client.BaseURL != DefaultBaseURL {
+		t.Errorf("Invalid client: %+v\n", client)
+	}
+}
+
+func TestNewClientFromConfigFileEnv(t *testing.T) {
+	t.Setenv("SAUCE_USERNAME", "")
+	t.Setenv("SAUCE_ACCESS_KEY", "env-key")
+
+	var path = writeConfigFile(t, "username: john\n")
+
+	client, err := NewClientFromConfigFile(path)
+	if err != nil {
+		t.Fatalf("NewClientFromConfigFile errored %+v\n", err)
+	}
+	if client.Username != "john" || client.Password != "env-key" {
+		t.Errorf("Invalid client: %+v\n", client)
+	}
+}
+
+func TestNewClientFromConfigFileErrors(t *testing.T) {
+	t.Setenv("SAUCE_USERNAME", "")
+	t.Setenv("SAUCE_ACCESS_KEY", "")
+
+	var tests = []struct {
+		path, message string
+	}{
+		{filepath.Join(t.TempDir(), "missing.yml"), "couldn't read"},
+		{writeConfigFile(t, "username john\n"), "line 1"},
+		{writeConfigFile(t, "username: john\n"), "missing accessKey"},
+	}
+
+	for _, test := range tests {
+		_, err := NewClientFromConfigFile(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Invalid error for %s: %v", test.path, err)
+		}
+	}
+}
+
+func TestTunnelConfigToRequest(t *testing.T) {
+	var config TunnelConfig
+	var err = json.Unmarshal([]byte(`{
+		"tunnel_identifier": "web",
+		"domain_names": ["*.example.com"],
+		"use_kgp": false,
+		"metadata": {"command": "sc --tunnel-name web"},
+		"labels": {"team": "frontend"},
+		"extra_info": {"inject_job_id": true}
+	}`), &config)
+	if err != nil {
+		t.Fatalf("json.Unmarshal errored %+v\n", err)
+	}
+
+	request, err := config.ToRequest()
+	if err != nil {
+		t.Fatalf("config.ToRequest errored %+v\n", err)
+	}
+	if request.TunnelIdentifier != "web" ||
+		!reflect.DeepEqual(request.DomainNames, []string{"*.example.com"}) ||
+		request.UseKGP == nil || *request.UseKGP ||
+		request.Metadata.Command != "sc --tunnel-name web" ||
+		request.Labels["team"] != "frontend" ||
+		request.ExtraInfo != `{"inject_job_id":true}` {
+		t.Errorf("Invalid request: %+v\n", request)
+	}
+
+	config.DomainNames = []string{"bad domain"}
+	if _, err = config.ToRequest(); !errors.Is(err, ErrInvalidDomain) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestTunnelConfigLargeNumbers(t *testing.T) {
+	var config TunnelConfig
+	var err = json.Unmarshal([]byte(`{
+		"domain_names": ["sauce-connect.proxy"],
+		"extra_info": {"job_id": 9007199254740993, "ratio": 0.5}
+	}`), &config)
+	if err != nil {
+		t.Fatalf("json.Unmarshal errored %+v\n", err)
+	}
+
+	request, err := config.ToRequest()
+	if err != nil {
+		t.Fatalf("config.ToRequest errored %+v\n", err)
+	}
+	if request.ExtraInfo != `{"job_id":9007199254740993,"ratio":0.5}` {
+		t.Errorf("Invalid extra info: %s", request.ExtraInfo)
+	}
+}
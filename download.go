@@ -0,0 +1,333 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Returned by Download when the downloaded file doesn't match the expected
+// SHA1 digest
+//
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+//
+// Returned by Download when the connection was lost before the end of the
+// file
+//
+var ErrIncompleteDownload = errors.New("incomplete download")
+
+//
+// Download the file at `url`, usually a Sauce Connect build, to `path`.
+//
+// The validator of the file, its ETag or Last-Modified date, is saved next to
+// it in `path` + ".validator" while it's downloaded. If `path` already exists
+// with a validator, it's considered a partial download and only the rest of
+// the file is requested with Range and If-Range headers. When the server
+// doesn't support ranges, or the file changed on the server, it answers with
+// the whole file and the download starts over. A file without a validator is
+// always downloaded again from scratch.
+//
+// If `sha1sum` isn't empty, the SHA1 digest of the file must match it.
+// Otherwise the file is removed, so the next download starts from scratch,
+// and ErrChecksumMismatch is returned.
+//
+// Failed transfers are retried up to Client.MaxRetries times, resuming from
+// what was already downloaded: connection errors, 5xx statuses, and transfers
+// interrupted before the end of the file. The delay between two attempts
+// starts at Client.RetryDelay and doubles after each attempt. A checksum
+// mismatch isn't retried.
+//
+// The digest only guarantees the integrity of the file, not its authenticity:
+// it's published in the version manifest, next to the download URL, so anyone
+// able to tamper with the file can usually tamper with the digest too. Sauce
+// Labs doesn't publish signatures of its builds, so there's nothing stronger
+// to check.
+//
+func (c *Client) Download(ctx context.Context, url, path, sha1sum string) (
+	err error,
+) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var delay = c.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+
+	var validatorPath = path + ".validator"
+	for attempt := 0; ; attempt++ {
+		err = c.fetch(ctx, url, file, validatorPath)
+		if err == nil {
+			break
+		}
+		if attempt >= c.MaxRetries || !isTransientDownload(err) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.getClock().After(delay):
+		}
+		delay *= 2
+	}
+
+	os.Remove(validatorPath)
+	if sha1sum == "" {
+		return nil
+	}
+	if err = verifySHA1(file, sha1sum); errors.Is(err, ErrChecksumMismatch) {
+		file.Close()
+		os.Remove(path)
+	}
+	return
+}
+
+//
+// Download `url` into `file`: if the validator saved at `validatorPath` is
+// still the file's, the rest of the file is appended, otherwise `file` is
+// truncated and the whole file is written.
+//
+func (c *Client) fetch(
+	ctx context.Context,
+	url string,
+	file *os.File,
+	validatorPath string,
+) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if validator, _ := os.ReadFile(validatorPath); len(validator) > 0 {
+		if offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", string(validator))
+		}
+	}
+
+	// The builds aren't served by the REST API, its pinned certificates
+	// don't apply
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return &ConnectError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		// Resume where the partial download stopped
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable &&
+		offset > 0:
+		if rangeTotal(resp.Header.Get("Content-Range")) == offset {
+			// The partial download is already complete
+			return nil
+		}
+		// The local file is larger than the file on the server
+		resp.Body.Close()
+		if err = os.Remove(validatorPath); err != nil {
+			return err
+		}
+		return c.fetch(ctx, url, file, validatorPath)
+	case resp.StatusCode == http.StatusOK:
+		if err = file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err = saveValidator(validatorPath, resp.Header); err != nil {
+			return err
+		}
+	default:
+		var message, _ = io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+		return &APIError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(message)),
+			RequestID:  resp.Header.Get("X-Request-Id"),
+		}
+	}
+
+	// The body fails with io.ErrUnexpectedEOF if the connection is closed
+	// before the end
+	_, err = io.Copy(file, readErrorReader{resp.Body})
+	return err
+}
+
+//
+// Return the total size of the file from the Content-Range header of a 416
+// response, like "bytes */1234", or -1 if it's unknown
+//
+func rangeTotal(contentRange string) int64 {
+	var _, total, ok = strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	var size, err = strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+//
+// Save the validator of the response with `header` at `path`: its strong ETag,
+// or its Last-Modified date. Without one, a partial download can't be resumed
+// safely and the file at `path` is removed.
+//
+func saveValidator(path string, header http.Header) error {
+	var validator = header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(validator), 0644)
+}
+
+//
+// Wrap read errors with ErrIncompleteDownload, to tell them apart from write
+// errors after io.Copy
+//
+type readErrorReader struct {
+	io.Reader
+}
+
+func (r readErrorReader) Read(p []byte) (int, error) {
+	var n, err = r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", ErrIncompleteDownload, err)
+	}
+	return n, err
+}
+
+//
+// Return true if the download failed in a way that may not happen again
+//
+func isTransientDownload(err error) bool {
+	var connectErr *ConnectError
+	var apiErr *APIError
+
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &connectErr),
+		errors.Is(err, ErrIncompleteDownload):
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+//
+// Check that the SHA1 digest of `file` is `sha1sum`
+//
+func verifySHA1(file *os.File, sha1sum string) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var hash = sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	var digest = hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(digest, sha1sum) {
+		return fmt.Errorf(
+			"%w: %s is %s, expected %s",
+			ErrChecksumMismatch, file.Name(), digest, sha1sum)
+	}
+
+	return nil
+}
+
+//
+// Stream the file at `url` to `w`, for example into an archive extractor, and
+// return the number of bytes written. If `client` is nil, http.DefaultClient
+// is used. Unlike Client.Download, there's no resuming or retrying: a failed
+// transfer fails with ErrIncompleteDownload, and canceling `ctx` aborts the
+// transfer mid-stream.
+//
+// If `sha1sum` isn't empty, the SHA1 digest of the body is computed while it's
+// streamed, and ErrChecksumMismatch is returned once the whole body is
+// written if it doesn't match. `w` has then already received the data: it's
+// up to the caller to discard it.
+//
+func DownloadTo(
+	ctx context.Context,
+	url string,
+	w io.Writer,
+	client *http.Client,
+	sha1sum string,
+) (written int64, err error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, &ConnectError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message, _ = io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+		return 0, &APIError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(message)),
+			RequestID:  resp.Header.Get("X-Request-Id"),
+		}
+	}
+
+	var hash = sha1.New()
+	written, err = io.Copy(
+		io.MultiWriter(w, hash), readErrorReader{resp.Body})
+	if err != nil || sha1sum == "" {
+		return
+	}
+
+	var digest = hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(digest, sha1sum) {
+		err = fmt.Errorf(
+			"%w: %s is %s, expected %s",
+			ErrChecksumMismatch, url, digest, sha1sum)
+	}
+	return
+}
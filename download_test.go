@@ -0,0 +1,321 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var downloadContent = strings.Repeat("Sauce Connect ", 1000)
+
+func downloadSHA1() string {
+	var sum = sha1.Sum([]byte(downloadContent))
+	return hex.EncodeToString(sum[:])
+}
+
+// ETag of downloadContent
+const downloadETag = `"sc-1"`
+
+// Serve downloadContent with support for Range requests, and record the
+// Range header of each request
+func rangeServer(ranges *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*ranges = append(*ranges, r.Header.Get("Range"))
+			w.Header().Set("ETag", downloadETag)
+			http.ServeContent(w, r, "sc", time.Time{},
+				strings.NewReader(downloadContent))
+		}))
+}
+
+// Write `content` at `path` as a partial download of the file with `etag`
+func writePartial(path, content, etag string) {
+	os.WriteFile(path, []byte(content), 0644)
+	os.WriteFile(path+".validator", []byte(etag), 0644)
+}
+
+func TestDownload(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	var client = Client{}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+
+	if content, _ := os.ReadFile(path); string(content) != downloadContent {
+		t.Errorf("Invalid content: %d bytes", len(content))
+	}
+	if len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("Invalid ranges: %q", ranges)
+	}
+}
+
+func TestDownloadNotPinned(t *testing.T) {
+	var server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, downloadContent)
+		}))
+	defer server.Close()
+
+	// The pins are the REST API's, not the download server's
+	var path = filepath.Join(t.TempDir(), "sc")
+	var client = Client{
+		Client:           *server.Client(),
+		PinnedCertSHA256: [][]byte{make([]byte, 32)},
+	}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	writePartial(path, downloadContent[:1000], downloadETag)
+	var client = Client{}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+
+	if content, _ := os.ReadFile(path); string(content) != downloadContent {
+		t.Errorf("Invalid content: %d bytes", len(content))
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=1000-" {
+		t.Errorf("Invalid ranges: %q", ranges)
+	}
+	if _, err := os.Stat(path + ".validator"); !os.IsNotExist(err) {
+		t.Errorf("The validator wasn't removed: %v", err)
+	}
+}
+
+func TestDownloadResumeStale(t *testing.T) {
+	var tests = []struct {
+		name, content, etag string
+	}{
+		// Without a validator, the file may be anything
+		{"unknown", "garbage", ""},
+		// The file changed on the server
+		{"changed", "garbage", `"sc-0"`},
+		// The file is larger than the one on the server
+		{"larger", downloadContent + "garbage", downloadETag},
+	}
+
+	for _, test := range tests {
+		var ranges []string
+		var server = rangeServer(&ranges)
+
+		var path = filepath.Join(t.TempDir(), "sc")
+		writePartial(path, test.content, test.etag)
+		var client = Client{}
+
+		var err = client.Download(
+			context.Background(), server.URL, path, "")
+		if err != nil {
+			t.Errorf("%s: client.Download errored %+v\n", test.name, err)
+		}
+		if content, _ := os.ReadFile(path); string(content) != downloadContent {
+			t.Errorf("%s: invalid content: %d bytes", test.name, len(content))
+		}
+		server.Close()
+	}
+}
+
+func TestDownloadComplete(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	writePartial(path, downloadContent, downloadETag)
+	var client = Client{}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+	if len(ranges) != 1 {
+		t.Errorf("Invalid ranges: %q", ranges)
+	}
+}
+
+func TestDownloadNoRanges(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(downloadContent))
+		}))
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	os.WriteFile(path, []byte("garbage"), 0644)
+	var client = Client{}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+
+	if content, _ := os.ReadFile(path); string(content) != downloadContent {
+		t.Errorf("Invalid content: %d bytes", len(content))
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	writePartial(path, strings.Repeat("x", 1000), downloadETag)
+	var client = Client{}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Corrupted file wasn't removed: %v", err)
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			switch requests {
+			case 1:
+				http.Error(w, "Bad gateway", 502)
+			case 2:
+				// Promise the whole file, but stop half-way
+				w.Header().Set("ETag", downloadETag)
+				w.Header().Set("Content-Length",
+					strconv.Itoa(len(downloadContent)))
+				w.Write([]byte(downloadContent[:5000]))
+			default:
+				if r.Header.Get("Range") != "bytes=5000-" {
+					t.Errorf("Invalid range: %q", r.Header.Get("Range"))
+				}
+				w.Header().Set("ETag", downloadETag)
+				http.ServeContent(w, r, "sc", time.Time{},
+					strings.NewReader(downloadContent))
+			}
+		}))
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	var clock = fakeClock{}
+	var client = Client{MaxRetries: 2, clock: &clock}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, downloadSHA1())
+	if err != nil {
+		t.Errorf("client.Download errored %+v\n", err)
+	}
+
+	if content, _ := os.ReadFile(path); string(content) != downloadContent {
+		t.Errorf("Invalid content: %d bytes", len(content))
+	}
+	// Waited 1s then 2s
+	if requests != 3 || clock.now != (time.Time{}).Add(3*time.Second) {
+		t.Errorf("Invalid retries: %d requests, %s", requests, clock.now)
+	}
+}
+
+func TestDownloadNoRetryChecksumMismatch(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "sc")
+	var client = Client{MaxRetries: 2, clock: &fakeClock{}}
+
+	var err = client.Download(
+		context.Background(), server.URL, path, "0123456789")
+	if !errors.Is(err, ErrChecksumMismatch) || len(ranges) != 1 {
+		t.Errorf("Invalid error: %v after %d requests", err, len(ranges))
+	}
+}
+
+func TestDownloadTo(t *testing.T) {
+	var ranges []string
+	var server = rangeServer(&ranges)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	written, err := DownloadTo(
+		context.Background(), server.URL, &buf, nil, downloadSHA1())
+	if err != nil {
+		t.Errorf("DownloadTo errored %+v\n", err)
+	}
+	if written != int64(len(downloadContent)) ||
+		buf.String() != downloadContent {
+		t.Errorf("Invalid content: %d bytes", written)
+	}
+
+	buf.Reset()
+	_, err = DownloadTo(
+		context.Background(), server.URL, &buf, server.Client(), "0000")
+	if !errors.Is(err, ErrChecksumMismatch) ||
+		buf.String() != downloadContent {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+// Cancel a context on the first write
+type cancelingWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return len(p), nil
+}
+
+func TestDownloadToCanceled(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1000000")
+			io.WriteString(w, downloadContent)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := DownloadTo(ctx, server.URL, cancelingWriter{cancel}, nil, "")
+	if !errors.Is(err, context.Canceled) ||
+		!errors.Is(err, ErrIncompleteDownload) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
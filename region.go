@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//
+// Sauce Labs data center. The REST API of each region has its own base URL,
+// see Region.BaseURL.
+//
+type Region string
+
+const (
+	RegionUSWest1    Region = "us-west-1"
+	RegionUSEast4    Region = "us-east-4"
+	RegionEUCentral1 Region = "eu-central-1"
+)
+
+// Hostnames of the REST API by region, the first one is the default
+var regionHosts = map[Region][]string{
+	RegionUSWest1: {
+		"api.us-west-1.saucelabs.com",
+		"saucelabs.com",
+		"us-west-1.saucelabs.com",
+	},
+	RegionUSEast4: {
+		"api.us-east-4.saucelabs.com",
+		"us-east-4.saucelabs.com",
+	},
+	RegionEUCentral1: {
+		"api.eu-central-1.saucelabs.com",
+		"eu-central-1.saucelabs.com",
+	},
+}
+
+//
+// Return the base URL of the REST API in the region, an empty string for an
+// unknown region.
+//
+func (r Region) BaseURL() string {
+	var hosts = regionHosts[r]
+	if len(hosts) == 0 {
+		return ""
+	}
+	return "https://" + hosts[0] + "/rest/v1"
+}
+
+//
+// Return the region of the REST API at `baseURL`, false if the host isn't a
+// known Sauce Labs endpoint.
+//
+func RegionFromBaseURL(baseURL string) (Region, bool) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", false
+	}
+
+	var host = strings.ToLower(u.Hostname())
+	for region, hosts := range regionHosts {
+		for _, h := range hosts {
+			if host == h {
+				return region, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+//
+// Return the tunnels older than the minimum build of Sauce Connect required in
+// the client's region by `minByRegion`, indexed by id. The build comes from the
+// tunnels' metadata, see FindOutdated. Nothing is required in regions missing
+// from `minByRegion`. Fail if Client.BaseURL isn't a known region.
+//
+func (c *Client) AuditReleases(minByRegion map[Region]int, opts ...Option) (
+	map[string]Tunnel, error,
+) {
+	region, ok := RegionFromBaseURL(c.BaseURL)
+	if !ok {
+		return nil, fmt.Errorf("unknown region for %s", c.BaseURL)
+	}
+
+	var audit = make(map[string]Tunnel)
+	minBuild, ok := minByRegion[region]
+	if !ok {
+		return audit, nil
+	}
+
+	outdated, err := c.FindOutdated(minBuild, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, tunnel := range outdated {
+		audit[tunnel.Id] = tunnel
+	}
+
+	return audit, nil
+}
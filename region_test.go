@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegionFromBaseURL(t *testing.T) {
+	var tests = []struct {
+		baseURL string
+		region  Region
+		ok      bool
+	}{
+		{"https://saucelabs.com/rest/v1", RegionUSWest1, true},
+		{"https://api.us-west-1.saucelabs.com/rest/v1", RegionUSWest1, true},
+		{"https://API.EU-CENTRAL-1.saucelabs.com/rest/v1", RegionEUCentral1, true},
+		{"https://api.us-east-4.saucelabs.com:443/rest/v1", RegionUSEast4, true},
+		{"http://localhost:8080/rest/v1", "", false},
+		{"://invalid", "", false},
+	}
+
+	for _, test := range tests {
+		region, ok := RegionFromBaseURL(test.baseURL)
+		if region != test.region || ok != test.ok {
+			t.Errorf("RegionFromBaseURL(%q) returned %q %t",
+				test.baseURL, region, ok)
+		}
+	}
+}
+
+func TestRegionBaseURL(t *testing.T) {
+	for region := range regionHosts {
+		if r, ok := RegionFromBaseURL(region.BaseURL()); !ok || r != region {
+			t.Errorf("Invalid base URL for %s: %s", region, region.BaseURL())
+		}
+	}
+	if url := Region("mars-1").BaseURL(); url != "" {
+		t.Errorf("Invalid base URL for an unknown region: %s", url)
+	}
+}
+
+// Send all requests to `server`, whatever their host
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var u = *req.URL
+	u.Scheme, u.Host = "http", t.server.Listener.Addr().String()
+	req = req.Clone(req.Context())
+	req.URL = &u
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientAuditReleases(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "below", "status": "running", "metadata": {"build": "4000"}},
+			{"id": "at", "status": "running", "metadata": {"build": "5000"}},
+			{"id": "above", "status": "running", "metadata": {"build": 6000}}]`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  RegionEUCentral1.BaseURL(),
+		Username: "username",
+		Password: "password",
+		Client:   http.Client{Transport: redirectTransport{server}},
+	}
+
+	audit, err := client.AuditReleases(map[Region]int{
+		RegionUSWest1:    7000,
+		RegionEUCentral1: 5000,
+	})
+	if err != nil {
+		t.Fatalf("client.AuditReleases errored %+v\n", err)
+	}
+	if len(audit) != 1 || audit["below"].Id != "below" {
+		t.Errorf("Invalid audit: %+v", audit)
+	}
+
+	client.BaseURL = "http://localhost:8080/rest/v1"
+	if _, err = client.AuditReleases(nil); err == nil {
+		t.Errorf("client.AuditReleases didn't fail for an unknown region")
+	}
+}
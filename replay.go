@@ -0,0 +1,151 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+//
+// Request and response recorded by RecordingTransport
+//
+type Interaction struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+//
+// HTTP transport recording the requests sent through it and their responses
+// to the JSON file Path, rewritten after each request. Use it as the
+// transport of a Client to record interactions with the REST API, and replay
+// them in tests with ReplayTransport. The recorded requests aren't redacted,
+// but their credentials aren't recorded.
+//
+type RecordingTransport struct {
+	Path string
+	// Transport sending the requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	mutex        sync.Mutex
+	interactions []Interaction
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (
+	*http.Response, error,
+) {
+	var transport = t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.interactions = append(t.interactions, Interaction{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(body),
+	})
+
+	data, err := json.MarshalIndent(t.interactions, "", "  ")
+	if err == nil {
+		err = os.WriteFile(t.Path, data, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't record interaction: %s", err)
+	}
+
+	return resp, nil
+}
+
+//
+// HTTP transport answering requests with the interactions recorded by
+// RecordingTransport, without sending them. Requests are matched by method
+// and path, in the order they were recorded: each interaction is only used
+// once.
+//
+type ReplayTransport struct {
+	mutex        sync.Mutex
+	interactions []Interaction
+}
+
+//
+// Return a ReplayTransport replaying the interactions recorded in the file
+// `path`
+//
+func NewReplayTransport(path string) (*ReplayTransport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t ReplayTransport
+	if err = json.Unmarshal(data, &t.interactions); err != nil {
+		return nil, fmt.Errorf("couldn't decode recording %s: %s", path, err)
+	}
+
+	return &t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (
+	*http.Response, error,
+) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, interaction := range t.interactions {
+		if interaction.Method != req.Method ||
+			interaction.Path != req.URL.Path {
+			continue
+		}
+		t.interactions = append(t.interactions[:i], t.interactions[i+1:]...)
+
+		var header = interaction.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Content-Length", strconv.Itoa(len(interaction.Body)))
+
+		return &http.Response{
+			Status: fmt.Sprintf("%d %s", interaction.StatusCode,
+				http.StatusText(interaction.StatusCode)),
+			StatusCode:    interaction.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewBufferString(interaction.Body)),
+			ContentLength: int64(len(interaction.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf(
+		"no recorded response for %s %s", req.Method, req.URL.Path)
+}
@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var server = multiResponseServer([]R{
+		jsonResponse(createJSON),
+		errorResponse(404, "Not found"),
+	})
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), "recording.json")
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Client: http.Client{
+			Transport: &RecordingTransport{Path: path},
+		},
+	}
+
+	recorded, err := client.GetTunnel("49958ce5ec9f49c796542e0c691455a6")
+	if err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+	if _, err = client.GetTunnel("gone"); err == nil {
+		t.Errorf("client.GetTunnel didn't error")
+	}
+
+	transport, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatalf("NewReplayTransport errored %+v\n", err)
+	}
+	server.Close()
+	client.Client.Transport = transport
+
+	// Replayed in a different order
+	var apiErr *APIError
+	if _, err = client.GetTunnel("gone"); !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != 404 {
+		t.Errorf("Invalid error: %v", err)
+	}
+	replayed, err := client.GetTunnel("49958ce5ec9f49c796542e0c691455a6")
+	if err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+	if replayed.Id != recorded.Id || replayed.State != recorded.State {
+		t.Errorf("Invalid tunnel: %+v\n", replayed)
+	}
+
+	// Each interaction is replayed once
+	if _, err = client.GetTunnel("gone"); err == nil {
+		t.Errorf("client.GetTunnel didn't error")
+	}
+}
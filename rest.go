@@ -2,20 +2,39 @@ package rest
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"reflect"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 //
-// Decode `reader` into the object `v`, and close `reader` after.
+// Decode `reader` into the object `v`, and close `reader` after. Numbers
+// decoded into an interface{} are json.Number rather than float64, so large
+// integers stay exact.
 //
 func decodeJSON(reader io.ReadCloser, v interface{}) error {
-	var err = json.NewDecoder(reader).Decode(v)
+	var decoder = json.NewDecoder(reader)
+	decoder.UseNumber()
+	var err = decoder.Decode(v)
 	reader.Close()
 	if err != nil {
 		return fmt.Errorf("couldn't decode JSON document: %s", err)
@@ -41,385 +60,3889 @@ type Client struct {
 	Username string
 	Password string
 
+	// HTTP client used for all the requests of the package, including
+	// downloads. Its transport is always used: methods needing a different
+	// transport, like PinnedCertSHA256, copy it. For example to connect
+	// through a SOCKS5 proxy with golang.org/x/net/proxy:
+	//
+	//	dialer, _ := proxy.SOCKS5("tcp", "localhost:1080", nil, proxy.Direct)
+	//	client.Client.Transport = &http.Transport{
+	//		DialContext: dialer.(proxy.ContextDialer).DialContext,
+	//	}
 	Client http.Client
 
+	// Maximum number of concurrent tunnels allowed for the account. The REST
+	// API doesn't report this limit, set it according to the account's plan
+	// for ConcurrencyLimits to return it. 0 means unknown.
+	MaxTunnels int
+
+	// How long Create waits for a new tunnel to come up, one minute if zero
+	CreateTimeout time.Duration
+	// Delay between two status queries when waiting for a tunnel to reach a
+	// status, one second if zero
+	PollInterval time.Duration
+	// Policy for the delay between two status queries, replacing
+	// PollInterval if set. WithBackoff overrides it for a single call.
+	Backoff Backoff
+
+	// Thresholds used by ListWithHealth: a tunnel that's still booting after
+	// MaxBootTime failed to boot, ten minutes if zero, and a running tunnel
+	// without a client for more than MaxIdleTime is idle, one hour if zero.
+	MaxBootTime time.Duration
+	MaxIdleTime time.Duration
+
+	// Compute the age of tunnels relative to the server's time instead of
+	// the local time, to be immune to a local clock that's off. The server's
+	// time comes from the Date header of the last response. Without it,
+	// ages are computed with the local time, and clamped to zero when the
+	// local clock is behind.
+	UseServerTime bool
+
+	// Number of times a failed request is retried, 0 disables retries. Only
+	// idempotent requests are retried, and only when the failure looks
+	// transient: connection errors, 5xx statuses, or a response that isn't a
+	// JSON document like a proxy's error page.
+	MaxRetries int
+	// Delay between two attempts, one second if zero
+	RetryDelay time.Duration
+	// Decide if a failed attempt is retried instead of the default policy
+	// described above. `resp` is nil if the request didn't get a response,
+	// its body is already closed. Requests are still retried at most
+	// MaxRetries times, and only if they're idempotent.
+	RetryPredicate func(resp *http.Response, err error) bool
+
+	// Maximum size of a request body in bytes, 0 means no limit. Larger
+	// requests fail with ErrRequestTooLarge before being sent, instead of
+	// being rejected by the server, for example when creating a tunnel with
+	// thousands of domains.
+	MaxRequestBytes int
+
+	// Maximum number of requests in flight at the same time, 0 means no
+	// limit. Other requests wait for a slot, or fail right away with
+	// ErrSaturated if FailWhenSaturated is set. The limit is read on first
+	// use, changing it after has no effect.
+	MaxConcurrency    int
+	FailWhenSaturated bool
+
+	// SHA-256 fingerprints of the certificates accepted for the REST API. If
+	// set, connections are refused unless the server's certificate is one
+	// of them, on top of the usual verification. The transport of Client
+	// must then be nil or an *http.Transport, which is copied to add the
+	// check. It's read on first use, changing it after has no effect. Only
+	// the requests to the REST API are pinned: Download and the webhooks go
+	// to other hosts, with other certificates.
+	PinnedCertSHA256 [][]byte
+
+	// Log every request sent to the REST API and its outcome if set, for
+	// example with log.Printf. The request bodies are logged too if
+	// LogBodies is set.
+	Logf      func(format string, v ...interface{})
+	LogBodies bool
+	// Return the value to log for the header `key`, or for the request's
+	// URL and body with the keys "URL" and "Body". The credentials are
+	// always redacted first by DefaultRedact, Redact only hides more: it
+	// receives "REDACTED" for the Authorization and cookie headers.
+	Redact func(key, value string) string
+
+	// Receive the duration of the phases of each request if set: "dns",
+	// "connect" and "tls" when a new connection is established, and "ttfb",
+	// the time between sending the request and receiving the first byte of
+	// the response. The durations come from net/http/httptrace, which isn't
+	// used when it's nil.
+	OnTimings func(phase string, d time.Duration)
+
+	// Extract a value from the context of each request, passed with
+	// WithContext, and send it in the header ContextHeader, X-Request-Id if
+	// empty. For example a correlation id for distributed tracing. Nothing
+	// is sent when it returns false.
+	ContextValue  func(ctx context.Context) (string, bool)
+	ContextHeader string
+
+	// Receive the lifecycle events of the tunnels managed by the client if
+	// set, see LifecycleEvent. Sending blocks until the event is received or
+	// the client is closed: the channel must be read continuously, or be
+	// buffered.
+	Events chan<- LifecycleEvent
+
+	// Cache for the version manifest, used by GetLastVersion & co. if set
+	VersionCache *VersionCache
+
 	// Methods to override the default decoding function
 	DecodeJSON func(reader io.ReadCloser, v interface{}) error
 	EncodeJSON func(writer io.Writer, v interface{}) error
+
+	// Clock used to wait and compute durations, the real clock if nil. Tests
+	// replace it to avoid real sleeps.
+	clock clock
+
+	// Created on first use, see getState
+	state *clientState
 }
 
 //
-// Query `baseURL/versions.json` for a new version of Sauce Connect
+// Change in the lifecycle of a tunnel, sent to Client.Events. Event is one of:
 //
-// Return the newest build number for the platform as determined by
-// runtime.GOOS, and the URL to download the latest verion.
+//   - "created": the REST API accepted the creation request
+//   - "running": the new tunnel came up
+//   - "failed": the creation failed, TunnelId is empty if the REST API
+//     didn't create the tunnel
+//   - "shutdown": the client shut the tunnel down
+//   - "down": the status loop of a tunnel created with Create noticed it
+//     went down
 //
-func (c *Client) GetLastVersion() (
-	build int, downloadUrl string, err error,
-) {
-	// We use only the hostname part of base url
-	u, err := url.Parse(c.BaseURL)
-	u.Path = ""
-	var fullUrl = fmt.Sprintf("%s/versions.json", u)
+// Status is the status of the tunnel reported by the REST API, if known.
+//
+type LifecycleEvent struct {
+	TunnelId string
+	Event    string
+	Status   string
+	Time     time.Time
+	Err      error
+}
 
-	// Structures we use to decode the json document
-	type jsonBuild struct {
-		Build       int
-		DownloadUrl string `json:"download_url"`
-		Sha1        string
+//
+// Send a lifecycle event to Client.Events if set
+//
+func (c *Client) emit(id, event, status string, err error) {
+	if c.Events == nil {
+		return
 	}
 
-	var jsonStruct = struct {
-		SauceConnect struct {
-			Linux   jsonBuild `json:"linux"`
-			Linux32 jsonBuild `json:"linux32"`
-			Osx     jsonBuild `json:"osx"`
-			Win32   jsonBuild `json:"win32"`
-		} `json:"Sauce Connect"`
-	}{}
-
-	err = c.executeRequest("GET", fullUrl, nil, &jsonStruct)
-	if err != nil {
-		return
+	var e = LifecycleEvent{
+		TunnelId: id,
+		Event:    event,
+		Status:   status,
+		Time:     c.getClock().Now(),
+		Err:      err,
 	}
+	select {
+	case c.Events <- e:
+	case <-c.getState().ctx.Done():
+	}
+}
+
+//
+// Mutable state of a Client. It's allocated on first use, since clients are
+// created as struct literals.
+//
+type clientState struct {
+	// Canceled when the client is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Semaphore of requests in flight, nil without Client.MaxConcurrency
+	slots chan struct{}
+
+	// Transport checking Client.PinnedCertSHA256, see httpClient
+	transport    *http.Transport
+	transportErr error
+
+	// Last list of tunnels returned by Client.ListCached, and its ETag
+	listMutex sync.Mutex
+	listETag  string
+	listCache []tunnelState
 
-	var p = jsonStruct.SauceConnect
-	var x jsonBuild
+	// Counters returned by Client.Stats
+	statsMutex    sync.Mutex
+	stats         Stats
+	boots         int
+	totalBootTime time.Duration
 
-	switch runtime.GOOS {
-	case "windows":
-		x = p.Win32
-	case "linux":
-		switch runtime.GOARCH {
-		case "386":
-			x = p.Linux32
-		case "amd64":
-			x = p.Linux
+	// Server time minus local time, see Client.UseServerTime
+	skewMutex sync.Mutex
+	skew      time.Duration
+
+	// Cached result of Client.AccountDefaults
+	defaultsMutex   sync.Mutex
+	defaults        *Request
+	defaultsExpires time.Time
+}
+
+// Protect the allocation of all clients' state
+var stateMutex sync.Mutex
+
+func (c *Client) getState() *clientState {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if c.state == nil {
+		var transport *http.Transport
+		var transportErr error
+		if len(c.PinnedCertSHA256) > 0 {
+			transport, transportErr = pinnedTransport(
+				c.Client.Transport, c.PinnedCertSHA256)
 		}
-	case "darwin":
-		x = p.Osx
-	default:
-		build = 0
-		downloadUrl = ""
-		err = fmt.Errorf("Unknown platform: %v", runtime.GOOS)
-		return
+		c.state = c.newState(transport, transportErr)
+	}
+	return c.state
+}
+
+//
+// Allocate the state of a new client using the pinned `transport`
+//
+func (c *Client) newState(
+	transport *http.Transport,
+	transportErr error,
+) *clientState {
+	ctx, cancel := context.WithCancel(context.Background())
+	var state = &clientState{
+		ctx:          ctx,
+		cancel:       cancel,
+		transport:    transport,
+		transportErr: transportErr,
 	}
+	if c.MaxConcurrency > 0 {
+		state.slots = make(chan struct{}, c.MaxConcurrency)
+	}
+	return state
+}
 
-	build = x.Build
-	downloadUrl = x.DownloadUrl
+//
+// Return a copy of the client using `username` and `password`, the original
+// client isn't modified. The copy shares the HTTP transport and the version
+// cache with the original, so clients for many accounts can reuse the same
+// connections.
+//
+// The copy has its own lifetime and MaxConcurrency slots: closing it doesn't
+// close the original, but it still closes the idle connections of the shared
+// transport.
+//
+func (c *Client) WithCredentials(username, password string) *Client {
+	var shared = c.getState()
 
-	return
+	stateMutex.Lock()
+	var clone = *c
+	stateMutex.Unlock()
+
+	clone.Username = username
+	clone.Password = password
+	clone.state = clone.newState(shared.transport, shared.transportErr)
+
+	return &clone
 }
 
-func (c *Client) ReportCrash(tunnel, info, logs string) error {
-	var doc = struct {
-		Tunnel string `json:"Tunnel"`
-		Info   string `json:"Info"`
-		Logs   string `json:"Logs"`
-	}{Tunnel: tunnel, Info: info, Logs: logs}
+//
+// Returned by the methods of a closed Client
+//
+var ErrClosed = errors.New("client closed")
 
-	var url = fmt.Sprintf("%s/%s/errors", c.BaseURL, c.Username)
+//
+// Returned when the certificate of the server isn't in
+// Client.PinnedCertSHA256
+//
+var ErrCertificateNotPinned = errors.New("certificate isn't pinned")
+
+//
+// Return a copy of `roundTripper` accepting only the certificates with the
+// SHA-256 fingerprints `pins`.
+//
+func pinnedTransport(roundTripper http.RoundTripper, pins [][]byte) (
+	*http.Transport, error,
+) {
+	var transport *http.Transport
+	switch t := roundTripper.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf(
+			"can't pin certificates with a transport of type %T", t)
+	}
+
+	var fingerprints = make([][]byte, len(pins))
+	copy(fingerprints, pins)
+
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	// VerifyConnection is called for resumed sessions too, unlike
+	// VerifyPeerCertificate
+	transport.TLSClientConfig.VerifyConnection = func(
+		state tls.ConnectionState,
+	) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrCertificateNotPinned
+		}
+		var sum = sha256.Sum256(state.PeerCertificates[0].Raw)
+		for _, fingerprint := range fingerprints {
+			if bytes.Equal(sum[:], fingerprint) {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"%w: SHA-256 fingerprint %x", ErrCertificateNotPinned, sum)
+	}
 
-	return c.executeRequest("POST", url, doc, nil)
+	return transport, nil
 }
 
-func (c *Client) decode(reader io.ReadCloser, v interface{}) error {
-	if reader == nil && v != nil {
-		return fmt.Errorf("can't decode JSON from a null reader")
+//
+// Return the HTTP client to send REST API requests with: Client, with the
+// pinned transport if Client.PinnedCertSHA256 is set.
+//
+func (c *Client) httpClient() (http.Client, error) {
+	var state = c.getState()
+	var client = c.Client
+
+	if state.transportErr != nil {
+		return client, state.transportErr
 	}
-	if c.DecodeJSON != nil {
-		return c.DecodeJSON(reader, v)
-	} else {
-		return decodeJSON(reader, v)
+	if state.transport != nil {
+		client.Transport = state.transport
 	}
+	return client, nil
 }
 
-func (c *Client) encode(writer io.Writer, v interface{}) error {
-	if writer == nil && v != nil {
-		return fmt.Errorf("can't encode JSON to a null writer")
+//
+// Returned when Client.MaxConcurrency requests are already in flight and
+// Client.FailWhenSaturated is set
+//
+var ErrSaturated = errors.New("too many requests in flight")
+
+//
+// Take a slot for a new request, the returned function releases it
+//
+func (c *Client) acquireSlot(ctx context.Context) (func(), error) {
+	var slots = c.getState().slots
+	if slots == nil {
+		return func() {}, nil
 	}
-	if c.EncodeJSON != nil {
-		return c.EncodeJSON(writer, v)
+
+	if c.FailWhenSaturated {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return nil, ErrSaturated
+		}
 	} else {
-		return encodeJSON(writer, v)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+
+	return func() { <-slots }, nil
 }
 
 //
-// Execute HTTP request and return an io.ReadCloser to be decoded
+// Returned when a request body is larger than Client.MaxRequestBytes
 //
-func (c *Client) executeRequest(
-	method, url string,
-	request, response interface{},
-) error {
-	var reader io.Reader
-	// Encode request JSON if needed
-	if request != nil {
-		var buf bytes.Buffer
-		if err := c.encode(&buf, request); err != nil {
-			return err
+var ErrRequestTooLarge = errors.New("request too large")
+
+//
+// Cancel the requests in flight, stop the goroutines started by Create, and
+// close the idle connections of the HTTP client. The client can't be used
+// after. Close can be called several times, and concurrently with other
+// methods.
+//
+func (c *Client) Close() error {
+	var state = c.getState()
+	state.cancel()
+	c.Client.CloseIdleConnections()
+	if state.transport != nil {
+		state.transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+//
+// Counters of the tunnels created by a client, see Client.Stats
+//
+type Stats struct {
+	CreatesAttempted int
+	CreatesSucceeded int
+	CreatesFailed    int
+
+	// Failed creations by reason: the REST API refused the creation request,
+	// the tunnel didn't come up in time, the REST API couldn't be reached, or
+	// anything else, including a canceled call or a closed client
+	FailedRejected  int
+	FailedTimeout   int
+	FailedTransport int
+	FailedOther     int
+
+	// Average time the successful creations took until the tunnel was
+	// running, creations with Request.NoWait aren't included
+	AverageBootTime time.Duration
+}
+
+//
+// Return the counters of the tunnels created since the client was created or
+// the last ResetStats. Only creation requests sent to the REST API are
+// counted, not the ones refused by Request.Validate.
+//
+func (c *Client) Stats() Stats {
+	var state = c.getState()
+	state.statsMutex.Lock()
+	defer state.statsMutex.Unlock()
+
+	return state.stats
+}
+
+//
+// Reset the counters returned by Stats
+//
+func (c *Client) ResetStats() {
+	var state = c.getState()
+	state.statsMutex.Lock()
+	defer state.statsMutex.Unlock()
+
+	state.stats = Stats{}
+	state.boots = 0
+	state.totalBootTime = 0
+}
+
+//
+// Count a creation that ended with `err` after `elapsed`. `waited` is true
+// if the tunnel was created and we waited for it to come up.
+//
+func (c *Client) recordCreate(err error, waited bool, elapsed time.Duration) {
+	var state = c.getState()
+	state.statsMutex.Lock()
+	defer state.statsMutex.Unlock()
+
+	var stats = &state.stats
+	stats.CreatesAttempted += 1
+	if err == nil {
+		stats.CreatesSucceeded += 1
+		if waited {
+			state.boots += 1
+			state.totalBootTime += elapsed
+			stats.AverageBootTime =
+				state.totalBootTime / time.Duration(state.boots)
 		}
-		reader = &buf
+		return
 	}
 
-	req, err := http.NewRequest(method, url, reader)
-	if err != nil {
-		return err
+	// Only the REST API refusing the POST is a rejection: an error of the
+	// status queries while waiting is a failure to come up like any other
+	var connectErr *ConnectError
+	var apiErr *APIError
+	stats.CreatesFailed += 1
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		stats.FailedTimeout += 1
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrClosed):
+		stats.FailedOther += 1
+	case errors.As(err, &connectErr):
+		stats.FailedTransport += 1
+	case errors.Is(err, ErrCreateRejected):
+		stats.FailedRejected += 1
+	case !waited && errors.As(err, &apiErr):
+		stats.FailedRejected += 1
+	default:
+		stats.FailedOther += 1
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(c.Username, c.Password)
+}
 
-	var client = c.Client
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("couldn't connect to %s: %s", req.URL, err)
+//
+// Redaction always applied before Client.Redact: hide the credentials of the
+// Authorization header and the cookies
+//
+func DefaultRedact(key, value string) string {
+	switch http.CanonicalHeaderKey(key) {
+	case "Authorization", "Cookie", "Set-Cookie":
+		return "REDACTED"
 	}
+	return value
+}
 
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return fmt.Errorf(
-			"error querying from %s. HTTP status: %s",
-			req.URL,
-			resp.Status)
+func (c *Client) redact(key, value string) string {
+	value = DefaultRedact(key, value)
+	if c.Redact != nil {
+		value = c.Redact(key, value)
 	}
+	return value
+}
 
-	// Decode response if needed
-	if response != nil {
-		return c.decode(resp.Body, response)
+//
+// Log `req` with Client.Logf
+//
+func (c *Client) logRequest(req *http.Request, body []byte) {
+	var keys = make([]string, 0, len(req.Header))
+	for key := range req.Header {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	return nil
-}
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s", req.Method, c.redact("URL", req.URL.String()))
+	for _, key := range keys {
+		for _, value := range req.Header[key] {
+			fmt.Fprintf(&line, " %s=%q", key, c.redact(key, value))
+		}
+	}
+	if c.LogBodies && body != nil {
+		fmt.Fprintf(&line, " body=%s", c.redact("Body", string(body)))
+	}
 
-type tunnelState struct {
-	Id               string   `json:"id"`
-	TunnelIdentifier string   `json:"tunnel_identifier"`
-	DomainNames      []string `json:"domain_names"`
+	c.Logf("rest: %s", line.String())
 }
 
 //
-// Return the list of tunnel states
+// Source of time for the client, see realClock.
 //
-func (c *Client) listTunnels() (states []tunnelState, err error) {
-	var url = fmt.Sprintf("%s/%s/tunnels?full=1", c.BaseURL, c.Username)
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
 
-	err = c.executeRequest("GET", url, nil, &states)
+type realClock struct{}
 
-	return
+func (realClock) Now() time.Time {
+	return time.Now()
 }
 
-func (c *Client) List() (ids []string, err error) {
-	states, err := c.listTunnels()
-	if err != nil {
-		return
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *Client) createTimeout() time.Duration {
+	if c.CreateTimeout == 0 {
+		return time.Minute
 	}
+	return c.CreateTimeout
+}
 
-	for _, state := range states {
-		ids = append(ids, state.Id)
+func (c *Client) pollInterval() time.Duration {
+	if c.PollInterval == 0 {
+		return time.Second
 	}
+	return c.PollInterval
+}
 
-	return
+func (c *Client) maxBootTime() time.Duration {
+	if c.MaxBootTime == 0 {
+		return 10 * time.Minute
+	}
+	return c.MaxBootTime
 }
 
-func checkOverlappingDomains(localDomains []string, remoteDomains []string) bool {
-	for _, localDomain := range localDomains {
-		for _, remoteDomain := range remoteDomains {
-			if localDomain == remoteDomain {
-				return true
-			}
-		}
+func (c *Client) maxIdleTime() time.Duration {
+	if c.MaxIdleTime == 0 {
+		return time.Hour
 	}
-	return false
+	return c.MaxIdleTime
+}
+
+func (c *Client) getClock() clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
 }
 
 //
-// Find tunnels: named tunnel with `name`, or tunnel matching one or more of
-// `domains`.
+// Return the current time to compare with the timestamps of the REST API: the
+// local time, corrected by the clock skew measured with the last response if
+// Client.UseServerTime is set
 //
-func (c *Client) Find(name string, domains []string) (
-	matches []string, err error,
-) {
-	list, err := c.listTunnels()
+func (c *Client) serverNow() time.Time {
+	var now = c.getClock().Now()
+	if !c.UseServerTime {
+		return now
+	}
+
+	var state = c.getState()
+	state.skewMutex.Lock()
+	defer state.skewMutex.Unlock()
+	return now.Add(state.skew)
+}
+
+//
+// Record the clock skew between the server and the local clock, from the Date
+// header of `resp`
+//
+func (c *Client) recordServerTime(resp *http.Response) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
 	if err != nil {
 		return
 	}
 
-	for _, state := range list {
-		if name != "" && state.TunnelIdentifier == name {
-			matches = append(matches, state.Id)
-			continue
-		}
+	var state = c.getState()
+	state.skewMutex.Lock()
+	defer state.skewMutex.Unlock()
+	state.skew = date.Sub(c.getClock().Now())
+}
 
-		if checkOverlappingDomains(domains, state.DomainNames) {
-			matches = append(matches, state.Id)
-		}
+//
+// Return the time elapsed since `t` according to the server's time, 0 if `t`
+// is unknown or in the future because of clock skew
+//
+func (c *Client) since(t time.Time) time.Duration {
+	var now time.Time
+	if c != nil {
+		now = c.serverNow()
+	} else {
+		now = time.Now()
 	}
 
-	return
+	if t.IsZero() || now.Before(t) {
+		return 0
+	}
+	return now.Sub(t)
 }
 
 //
-// Shutdown tunnel `id`
+// Return the name of the platform of the host in the version manifest, as
+// determined by runtime.GOOS and runtime.GOARCH.
 //
-func (c *Client) Shutdown(id string) (int, error) {
-	return c.shutdown("%s/%s/tunnels/%s", id)
+func HostPlatform() (string, error) {
+	return platformName(runtime.GOOS, runtime.GOARCH)
 }
 
-func (c *Client) shutdown(urlFmt, id string) (int, error) {
-	var url = fmt.Sprintf(urlFmt, c.BaseURL, c.Username, id)
+func platformName(goos, goarch string) (string, error) {
+	switch {
+	case goos == "windows":
+		return "win32", nil
+	case goos == "linux" && goarch == "386":
+		return "linux32", nil
+	case goos == "linux" && goarch == "amd64":
+		return "linux", nil
+	case goos == "darwin":
+		return "osx", nil
+	default:
+		return "", fmt.Errorf(
+			"Unknown platform: %s/%s has no Sauce Connect build", goos, goarch)
+	}
+}
 
-	var response struct {
-		JobsRunning int `json:"jobs_running"`
+// Build of Sauce Connect for a platform in the version manifest
+type versionBuild struct {
+	Build       int    `json:"build"`
+	DownloadUrl string `json:"download_url"`
+	Sha1        string `json:"sha1"`
+}
+
+func (c *Client) versionsURL() (string, error) {
+	// We use only the hostname part of base url
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = ""
+
+	return fmt.Sprintf("%s/versions.json", u), nil
+}
+
+//
+// Return the URLs the client queries for each operation, with "{id}" in place
+// of the tunnel id, for example to check the configuration of BaseURL. The
+// keys are "list", "create", "get", "shutdown", "heartbeat", "service status",
+// "errors" and "versions". Creating and listing tunnels use the same URL, as
+// do getting and shutting down a tunnel, with different methods.
+//
+func (c *Client) Endpoints() map[string]string {
+	var tunnels = fmt.Sprintf("%s/%s/tunnels", c.BaseURL, c.Username)
+	var endpoints = map[string]string{
+		"list":           tunnels + "?full=1",
+		"create":         tunnels,
+		"get":            tunnels + "/{id}",
+		"shutdown":       tunnels + "/{id}",
+		"heartbeat":      tunnels + "/{id}/connected",
+		"service status": fmt.Sprintf("%s/info/status", c.BaseURL),
+		"errors":         fmt.Sprintf("%s/%s/errors", c.BaseURL, c.Username),
+	}
+	if versions, err := c.versionsURL(); err == nil {
+		endpoints["versions"] = versions
+	}
+
+	return endpoints
+}
+
+//
+// Fetch `baseURL/versions.json` and return the Sauce Connect object: the
+// builds indexed by platform, along with a few non-platform keys like
+// "version".
+//
+func (c *Client) getManifest(opts ...Option) (
+	manifest map[string]json.RawMessage, err error,
+) {
+	fullUrl, err := c.versionsURL()
+	if err != nil {
+		return
+	}
+
+	var now = c.getClock().Now()
+	if manifest, ok := c.VersionCache.get(fullUrl, now); ok {
+		return manifest, nil
+	}
+
+	var jsonStruct struct {
+		SauceConnect map[string]json.RawMessage `json:"Sauce Connect"`
+	}
+
+	err = c.executeRequest("GET", fullUrl, nil, &jsonStruct, opts...)
+	if err != nil {
+		return
+	}
+
+	c.VersionCache.set(fullUrl, jsonStruct.SauceConnect, now)
+	return jsonStruct.SauceConnect, nil
+}
+
+//
+// In-memory cache of version manifests, indexed by URL: the manifest is only
+// fetched again once it's older than TTL. It's safe for concurrent use, so it
+// can be shared between clients.
+//
+type VersionCache struct {
+	TTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]versionCacheEntry
+}
+
+type versionCacheEntry struct {
+	manifest map[string]json.RawMessage
+	expires  time.Time
+}
+
+// Methods are no-ops on a nil cache, so clients can use it unconditionally
+func (vc *VersionCache) get(url string, now time.Time) (
+	map[string]json.RawMessage, bool,
+) {
+	if vc == nil {
+		return nil, false
+	}
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	var entry, ok = vc.entries[url]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	return entry.manifest, true
+}
+
+func (vc *VersionCache) set(
+	url string,
+	manifest map[string]json.RawMessage,
+	now time.Time,
+) {
+	if vc == nil {
+		return
+	}
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	if vc.entries == nil {
+		vc.entries = make(map[string]versionCacheEntry)
+	}
+	vc.entries[url] = versionCacheEntry{manifest, now.Add(vc.TTL)}
+}
+
+//
+// Empty the cache, so the next queries fetch the manifest again
+//
+func (vc *VersionCache) ForceRefresh() {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	vc.entries = nil
+}
+
+//
+// Query `baseURL/versions.json` for a new version of Sauce Connect
+//
+// Return the newest build number for the platform as determined by
+// runtime.GOOS, and the URL to download the latest verion.
+//
+// Errors have the same types as the other calls: a *ConnectError when the
+// server can't be reached, an *APIError matching ErrNotFound when there's no
+// manifest, a *DecodeError when it's invalid, and a
+// *PlatformNotAvailableError when it has no build for the platform.
+//
+func (c *Client) GetLastVersion(opts ...Option) (
+	build int, downloadUrl string, err error,
+) {
+	platform, err := HostPlatform()
+	if err != nil {
+		return
+	}
+
+	return c.GetLastVersionForPlatform(platform, opts...)
+}
+
+//
+// Same as GetLastVersion for `platform`, a key of the version manifest like
+// "linux" or "osx".
+//
+func (c *Client) GetLastVersionForPlatform(platform string, opts ...Option) (
+	build int, downloadUrl string, err error,
+) {
+	manifest, err := c.getManifest(opts...)
+	if err != nil {
+		return
+	}
+
+	raw, ok := manifest[platform]
+	if !ok {
+		err = &PlatformNotAvailableError{
+			Platform:  platform,
+			Available: manifestPlatforms(manifest),
+		}
+		return
+	}
+
+	var x versionBuild
+	if err = json.Unmarshal(raw, &x); err != nil {
+		var fullUrl, _ = c.versionsURL()
+		err = &DecodeError{
+			URL: fullUrl,
+			Err: fmt.Errorf("couldn't decode JSON document: %s", err),
+		}
+		return
+	}
+
+	build = x.Build
+	downloadUrl = x.DownloadUrl
+
+	return
+}
+
+//
+// Return the sorted list of platforms with a Sauce Connect build in the
+// version manifest, like "linux" or "osx". Use them with
+// GetLastVersionForPlatform.
+//
+func (c *Client) GetAvailablePlatforms(opts ...Option) ([]string, error) {
+	manifest, err := c.getManifest(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifestPlatforms(manifest), nil
+}
+
+func manifestPlatforms(manifest map[string]json.RawMessage) []string {
+	var platforms []string
+	for key, raw := range manifest {
+		// Builds are objects, other keys like "version" are strings
+		var value = bytes.TrimSpace(raw)
+		if len(value) > 0 && value[0] == '{' {
+			platforms = append(platforms, key)
+		}
+	}
+	sort.Strings(platforms)
+
+	return platforms
+}
+
+//
+// Matched by errors.Is for a *PlatformNotAvailableError
+//
+var ErrPlatformNotAvailable = errors.New("platform not available")
+
+//
+// Returned by GetLastVersionForPlatform when the version manifest has no
+// build for Platform. Available lists the platforms with a build, to pick a
+// compatible platform instead.
+//
+type PlatformNotAvailableError struct {
+	Platform  string
+	Available []string
+}
+
+func (e *PlatformNotAvailableError) Error() string {
+	return fmt.Sprintf(
+		"No Sauce Connect build for platform %s (available: %s)",
+		e.Platform, strings.Join(e.Available, ", "))
+}
+
+func (e *PlatformNotAvailableError) Is(target error) bool {
+	return target == ErrPlatformNotAvailable
+}
+
+func (c *Client) ReportCrash(tunnel, info, logs string, opts ...Option) error {
+	var doc = struct {
+		Tunnel string `json:"Tunnel"`
+		Info   string `json:"Info"`
+		Logs   string `json:"Logs"`
+	}{Tunnel: tunnel, Info: info, Logs: logs}
+
+	var url = fmt.Sprintf("%s/%s/errors", c.BaseURL, c.Username)
+
+	return c.executeRequest("POST", url, doc, nil, opts...)
+}
+
+func (c *Client) decode(reader io.ReadCloser, v interface{}) error {
+	if reader == nil && v != nil {
+		return fmt.Errorf("can't decode JSON from a null reader")
+	}
+	if c.DecodeJSON != nil {
+		return c.DecodeJSON(reader, v)
+	} else {
+		return decodeJSON(reader, v)
+	}
+}
+
+func (c *Client) encode(writer io.Writer, v interface{}) error {
+	if writer == nil && v != nil {
+		return fmt.Errorf("can't encode JSON to a null writer")
+	}
+	if c.EncodeJSON != nil {
+		return c.EncodeJSON(writer, v)
+	} else {
+		return encodeJSON(writer, v)
+	}
+}
+
+//
+// Per-call option, accepted by most Client methods to override the client's
+// settings for a single call without mutating the Client.
+//
+type Option func(*callOptions)
+
+type callOptions struct {
+	ctx     context.Context
+	timeout time.Duration
+	backoff Backoff
+
+	// Set by methods of the package, see withHeader, withResponse,
+	// withPollHook and withReadyCheck
+	header   http.Header
+	response **http.Response
+	onPoll   func(tunnel Tunnel)
+	ready    func(tunnel *Tunnel) bool
+}
+
+// Add a header to the request
+func withHeader(key, value string) Option {
+	return func(o *callOptions) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Set(key, value)
+	}
+}
+
+// Store the response of the last attempt in `resp`, its body is closed
+func withResponse(resp **http.Response) Option {
+	return func(o *callOptions) {
+		o.response = resp
+	}
+}
+
+// Call `hook` with the tunnel returned by each status query while polling
+func withPollHook(hook func(tunnel Tunnel)) Option {
+	return func(o *callOptions) {
+		o.onPoll = hook
+	}
+}
+
+// Wait until `ready` returns true instead of checking the tunnel's status
+func withReadyCheck(ready func(tunnel *Tunnel) bool) Option {
+	return func(o *callOptions) {
+		o.ready = ready
+	}
+}
+
+//
+// Abort the call if it didn't complete within `timeout`. This is independent
+// of the timeout of the Client's http.Client: the shortest one applies.
+//
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *callOptions) {
+		o.timeout = timeout
+	}
+}
+
+//
+// Run the call with `ctx`: the call is aborted when `ctx` is done.
+//
+func WithContext(ctx context.Context) Option {
+	return func(o *callOptions) {
+		o.ctx = ctx
+	}
+}
+
+//
+// Wait between two status queries according to `backoff` instead of
+// Client.Backoff, when the call polls the status of a tunnel.
+//
+func WithBackoff(backoff Backoff) Option {
+	return func(o *callOptions) {
+		o.backoff = backoff
+	}
+}
+
+//
+// Returned when the REST API couldn't be reached. Err is the error returned by
+// the http.Client, use errors.As to inspect it further: for example a
+// *net.DNSError for a DNS failure, or a *net.OpError for a refused
+// connection.
+//
+type ConnectError struct {
+	URL string
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("couldn't connect to %s: %s", e.URL, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Return true if the connection timed out
+func (e *ConnectError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// Return true if the error is temporary, see net.Error
+func (e *ConnectError) Temporary() bool {
+	var netErr interface{ Temporary() bool }
+	return errors.As(e.Err, &netErr) && netErr.Temporary()
+}
+
+//
+// Returned when the REST API answered with an error status. Message is the
+// beginning of the response body, it usually explains the error. RequestID is
+// the X-Request-Id header of the response if any, reference it when reporting
+// the error to Sauce Labs' support. A 404 status matches ErrNotFound with
+// errors.Is.
+//
+type APIError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string
+	RequestID  string
+}
+
+// Only the beginning of error responses is kept in APIError.Message
+const maxMessageSize = 4096
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf(
+			"error querying from %s. HTTP status: %s (request id: %s)",
+			e.URL, e.Status, e.RequestID)
+	}
+	return fmt.Sprintf(
+		"error querying from %s. HTTP status: %s", e.URL, e.Status)
+}
+
+//
+// Matched by an *APIError with a 404 status, for example when the tunnel or
+// the version manifest doesn't exist
+//
+var ErrNotFound = errors.New("not found")
+
+//
+// Returned when a response couldn't be decoded. Transient is true when the
+// response wasn't a JSON document, like an HTML error page from a proxy,
+// rather than a JSON document not matching what we expected.
+//
+type DecodeError struct {
+	URL         string
+	ContentType string
+	Transient   bool
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Transient {
+		return fmt.Sprintf(
+			"%s (unexpected content type %q)", e.Err, e.ContentType)
+	}
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+//
+// Read what's left of the response body before closing it, so the underlying
+// connection can be reused. We stop reading after maxDrainSize bytes: it's
+// cheaper to open a new connection than to read a huge body.
+//
+type drainingReadCloser struct {
+	io.ReadCloser
+}
+
+const maxDrainSize = 64 * 1024
+
+func (r drainingReadCloser) Close() error {
+	io.Copy(io.Discard, io.LimitReader(r.ReadCloser, maxDrainSize))
+	return r.ReadCloser.Close()
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// Return the context of a call made outside of executeRequest: the one passed
+// with WithContext, canceled when the client is closed
+//
+func (c *Client) callContext(opts ...Option) (
+	context.Context, context.CancelFunc,
+) {
+	var o callOptions
+	for _, option := range opts {
+		option(&o)
+	}
+
+	var parent = o.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	var stop = context.AfterFunc(c.getState().ctx, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+//
+// Execute HTTP request and decode its response into `response`, retrying it
+// according to Client.MaxRetries.
+//
+func (c *Client) executeRequest(
+	method, url string,
+	request, response interface{},
+	opts ...Option,
+) error {
+	var o callOptions
+	for _, option := range opts {
+		option(&o)
+	}
+
+	var closed = c.getState().ctx
+	if closed.Err() != nil {
+		return ErrClosed
+	}
+
+	var ctx = closed
+	if o.ctx != nil {
+		// Cancel the request when either the caller's context is done or
+		// the client is closed
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(o.ctx)
+		defer cancel()
+		defer context.AfterFunc(closed, cancel)()
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	// Encode request JSON if needed
+	var body []byte
+	if request != nil {
+		var buf bytes.Buffer
+		if err := c.encode(&buf, request); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	if c.MaxRequestBytes > 0 && len(body) > c.MaxRequestBytes {
+		return fmt.Errorf(
+			"%w: %s %s is %d bytes, the limit is %d bytes",
+			ErrRequestTooLarge, method, url, len(body), c.MaxRequestBytes)
+	}
+
+	var attempts = 1
+	if isIdempotent(method) {
+		attempts += c.MaxRetries
+	}
+
+	var delay = c.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+
+	var retriable = isTransient
+	if c.RetryPredicate != nil {
+		retriable = c.RetryPredicate
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doRequest(ctx, method, url, o.header, body, response)
+		if o.response != nil {
+			*o.response = resp
+		}
+		if err == nil || attempt >= attempts || !retriable(resp, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-c.getClock().After(delay):
+		}
+	}
+}
+
+//
+// Default retry policy: return true if the request failed and the failure
+// looks transient.
+//
+func isTransient(resp *http.Response, err error) bool {
+	var connectErr *ConnectError
+	var decodeErr *DecodeError
+
+	switch {
+	case errors.As(err, &connectErr):
+		return true
+	case errors.As(err, &decodeErr):
+		return decodeErr.Transient
+	default:
+		return resp != nil && resp.StatusCode >= 500
+	}
+}
+
+//
+// Execute a single HTTP request. `resp` is returned with its body closed, so
+// the caller can inspect the status and headers of failed requests.
+//
+func (c *Client) doRequest(
+	ctx context.Context,
+	method, url string,
+	header http.Header,
+	body []byte,
+	response interface{},
+) (resp *http.Response, err error) {
+	release, err := c.acquireSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	if c.OnTimings != nil {
+		ctx = c.traceTimings(ctx)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	// We don't set Accept-Encoding on purpose: http.Transport then requests
+	// gzip compressed responses and decompresses them transparently, but it
+	// doesn't if the header is set.
+	req.SetBasicAuth(c.Username, c.Password)
+	if c.ContextValue != nil {
+		if value, ok := c.ContextValue(ctx); ok {
+			var name = c.ContextHeader
+			if name == "" {
+				name = "X-Request-Id"
+			}
+			req.Header.Set(name, value)
+		}
+	}
+
+	client, err := c.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if c.Logf != nil {
+		c.logRequest(req, body)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		if c.Logf != nil {
+			c.Logf("rest: %s %s: %s", method,
+				c.redact("URL", req.URL.String()), err)
+		}
+		return nil, &ConnectError{URL: req.URL.String(), Err: err}
+	}
+	if c.Logf != nil {
+		c.Logf("rest: %s %s: %s", method,
+			c.redact("URL", req.URL.String()), resp.Status)
+	}
+	if c.UseServerTime {
+		c.recordServerTime(resp)
+	}
+	// Always read the body until the end, the connection can't be reused
+	// otherwise
+	var respBody = drainingReadCloser{resp.Body}
+	defer respBody.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message, _ = io.ReadAll(io.LimitReader(respBody, maxMessageSize))
+		return resp, &APIError{
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(message)),
+			RequestID:  resp.Header.Get("X-Request-Id"),
+		}
+	}
+
+	// Decode response if needed
+	if response != nil {
+		if err := c.decode(respBody, response); err != nil {
+			var contentType = resp.Header.Get("Content-Type")
+			return resp, &DecodeError{
+				URL:         req.URL.String(),
+				ContentType: contentType,
+				Transient:   !isJSONContentType(contentType),
+				Err:         err,
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+//
+// Return `ctx` with a trace reporting the phases of the request to
+// Client.OnTimings. Durations are measured with the real clock, since they're
+// about the network.
+//
+func (c *Client) traceTimings(ctx context.Context) context.Context {
+	// The dialer may connect to several addresses in parallel
+	var mutex sync.Mutex
+	var starts = make(map[string]time.Time)
+	var start = func(phase string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		starts[phase] = time.Now()
+	}
+	var done = func(phase, startPhase string) {
+		mutex.Lock()
+		var t, ok = starts[startPhase]
+		mutex.Unlock()
+		if ok {
+			c.OnTimings(phase, time.Since(t))
+		}
+	}
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			start("dns")
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			done("dns", "dns")
+		},
+		ConnectStart: func(network, addr string) {
+			start("connect " + addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			done("connect", "connect "+addr)
+		},
+		TLSHandshakeStart: func() {
+			start("tls")
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			done("tls", "tls")
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			start("ttfb")
+		},
+		GotFirstResponseByte: func() {
+			done("ttfb", "ttfb")
+		},
+	})
+}
+
+type serviceStatus struct {
+	ServiceOperational *bool  `json:"service_operational"`
+	StatusMessage      string `json:"status_message"`
+}
+
+//
+// Check that BaseURL is reachable and serves the REST API by querying
+// `BaseURL/info/status`. Return a *ConnectError if the REST API can't be
+// reached, an *APIError if it answered with an error status, and a
+// *DecodeError if the response isn't the expected JSON document, like a
+// captive portal's HTML page: DecodeError.ContentType is then the content
+// type of the response.
+//
+func (c *Client) HealthCheck(ctx context.Context) error {
+	if c.getState().ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	var url = fmt.Sprintf("%s/info/status", c.BaseURL)
+	var status serviceStatus
+
+	resp, err := c.doRequest(ctx, "GET", url, nil, nil, &status)
+	if err != nil {
+		return err
+	}
+
+	var contentType = resp.Header.Get("Content-Type")
+	if !isJSONContentType(contentType) {
+		return &DecodeError{
+			URL:         url,
+			ContentType: contentType,
+			Transient:   true,
+			Err:         errors.New("response isn't a JSON document"),
+		}
+	}
+	if status.ServiceOperational == nil {
+		return &DecodeError{
+			URL:         url,
+			ContentType: contentType,
+			Err:         errors.New("response isn't a service status"),
+		}
+	}
+	if !*status.ServiceOperational {
+		return fmt.Errorf(
+			"Sauce Labs service isn't operational: %s", status.StatusMessage)
+	}
+
+	return nil
+}
+
+//
+// Query `BaseURL/info/status` `samples` times, one request at a time and
+// without retries, and return the minimum, average, and maximum time the
+// requests took. It stops at the first failed request.
+//
+func (c *Client) MeasureLatency(ctx context.Context, samples int) (
+	min, avg, max time.Duration, err error,
+) {
+	if samples < 1 {
+		return 0, 0, 0, fmt.Errorf("invalid number of samples: %d", samples)
+	}
+	if c.getState().ctx.Err() != nil {
+		return 0, 0, 0, ErrClosed
+	}
+
+	var url = fmt.Sprintf("%s/info/status", c.BaseURL)
+	var clock = c.getClock()
+	var total time.Duration
+
+	for i := 0; i < samples; i++ {
+		var start = clock.Now()
+		if _, err = c.doRequest(ctx, "GET", url, nil, nil, nil); err != nil {
+			return 0, 0, 0, err
+		}
+		var elapsed = clock.Now().Sub(start)
+
+		total += elapsed
+		if i == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+	}
+
+	return min, total / time.Duration(samples), max, nil
+}
+
+type tunnelState struct {
+	Id               string       `json:"id"`
+	TunnelIdentifier string       `json:"tunnel_identifier"`
+	DomainNames      []string     `json:"domain_names"`
+	Status           string       `json:"status"`
+	Owner            string       `json:"owner"`
+	Host             string       `json:"host"`
+	SSHPort          int          `json:"ssh_port"`
+	UseKGP           bool         `json:"use_kgp"`
+	Metadata         jsonMetadata `json:"metadata"`
+	CreationTime     *int64       `json:"creation_time"`
+	LaunchTime       *int64       `json:"launch_time"`
+	LastConnected    *int64       `json:"last_connected"`
+	ShutdownTime     *int64       `json:"shutdown_time"`
+	UserShutdown     *bool        `json:"user_shutdown"`
+
+	// Fields of the document that aren't decoded above
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// JSON names of the fields decoded in tunnelState
+var tunnelStateFields = jsonFieldNames(reflect.TypeOf(tunnelState{}))
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	var names = make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		var name, _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+//
+// Decode the tunnel document, and keep the fields we don't know about in
+// Extra: the REST API adds fields from time to time.
+//
+func (s *tunnelState) UnmarshalJSON(data []byte) error {
+	type plainState tunnelState
+	if err := json.Unmarshal(data, (*plainState)(s)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name := range fields {
+		if tunnelStateFields[name] {
+			delete(fields, name)
+		}
+	}
+	s.Extra = nil
+	if len(fields) > 0 {
+		s.Extra = fields
+	}
+
+	return nil
+}
+
+//
+// Convert a UNIX timestamp from the REST API to a time.Time, null timestamps
+// are converted to the zero time.
+//
+func epochTime(timestamp *int64) time.Time {
+	if timestamp == nil {
+		return time.Time{}
+	}
+	return time.Unix(*timestamp, 0)
+}
+
+//
+// Convert the state returned by the REST API into a Tunnel bound to `c`
+//
+func (s *tunnelState) tunnel(c *Client) Tunnel {
+	return Tunnel{
+		Client:           c,
+		Id:               s.Id,
+		Host:             s.Host,
+		TunnelIdentifier: s.TunnelIdentifier,
+		DomainNames:      s.DomainNames,
+		State:            s.Status,
+		Owner:            s.Owner,
+		KGPPort:          s.SSHPort,
+		UseKGP:           s.UseKGP,
+		Metadata:         s.Metadata.Metadata,
+		Labels:           s.Metadata.Labels,
+		CreationTime:     epochTime(s.CreationTime),
+		LaunchTime:       epochTime(s.LaunchTime),
+		LastConnected:    epochTime(s.LastConnected),
+		ShutdownTime:     epochTime(s.ShutdownTime),
+		UserShutdown:     s.UserShutdown,
+		Extra:            s.Extra,
+	}
+}
+
+//
+// Return the list of tunnel states
+//
+func (c *Client) listTunnels(opts ...Option) (
+	states []tunnelState, err error,
+) {
+	var url = fmt.Sprintf("%s/%s/tunnels?full=1", c.BaseURL, c.Username)
+
+	err = c.executeRequest("GET", url, nil, &states, opts...)
+
+	return
+}
+
+//
+// Return the tunnels of the account with their details
+//
+func (c *Client) ListTunnels(opts ...Option) (tunnels []Tunnel, err error) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, state := range states {
+		tunnels = append(tunnels, state.tunnel(c))
+	}
+
+	return
+}
+
+//
+// Same as ListTunnels, but the list is only downloaded and decoded again if
+// it changed since the previous call: the previous list is returned if the
+// REST API answers 304 Not Modified to a request with the ETag of the previous
+// list. It's the same as ListTunnels if the REST API doesn't send ETags.
+//
+func (c *Client) ListCached(opts ...Option) (tunnels []Tunnel, err error) {
+	var state = c.getState()
+	state.listMutex.Lock()
+	defer state.listMutex.Unlock()
+
+	var url = fmt.Sprintf("%s/%s/tunnels?full=1", c.BaseURL, c.Username)
+	var states []tunnelState
+	var resp *http.Response
+	if state.listETag != "" {
+		opts = append(opts, withHeader("If-None-Match", state.listETag))
+	}
+	opts = append(opts, withResponse(&resp))
+
+	err = c.executeRequest("GET", url, nil, &states, opts...)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotModified {
+		states, err = state.listCache, nil
+	} else if err == nil {
+		state.listETag = resp.Header.Get("ETag")
+		state.listCache = nil
+		if state.listETag != "" {
+			state.listCache = states
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	for i := range states {
+		tunnels = append(tunnels, states[i].tunnel(c))
+	}
+	return
+}
+
+//
+// Return the tunnels created between `start` included and `end` excluded. The
+// REST API can't filter tunnels by creation time, so all the tunnels are
+// fetched and filtered locally.
+//
+func (c *Client) ListCreatedBetween(start, end time.Time, opts ...Option) (
+	tunnels []Tunnel, err error,
+) {
+	all, err := c.ListTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, tunnel := range all {
+		var created = tunnel.CreationTime
+		if !created.IsZero() && !created.Before(start) && created.Before(end) {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+
+	return
+}
+
+//
+// Fetch all the tunnels of the account and serialize them into a JSON
+// document, to be loaded later by LoadSnapshot. Tunnels are sorted by id so
+// snapshots of the same tunnels are identical.
+//
+func (c *Client) Snapshot(opts ...Option) ([]byte, error) {
+	tunnels, err := c.ListTunnels(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Id < tunnels[j].Id
+	})
+	if tunnels == nil {
+		tunnels = []Tunnel{}
+	}
+
+	return json.MarshalIndent(tunnels, "", "  ")
+}
+
+//
+// Write the tunnels of the account to `w` as newline-delimited JSON: one
+// tunnel per line, in the same format as Snapshot. If `w` has a Flush method,
+// like a *bufio.Writer or an http.ResponseWriter, it's flushed after each
+// tunnel. Stop early if `ctx` is done.
+//
+func (c *Client) StreamTunnels(ctx context.Context, w io.Writer) error {
+	tunnels, err := c.ListTunnels(WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	var encoder = json.NewEncoder(w)
+	for _, tunnel := range tunnels {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(tunnel); err != nil {
+			return err
+		}
+
+		switch f := w.(type) {
+		case interface{ Flush() error }:
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		case http.Flusher:
+			f.Flush()
+		}
+	}
+
+	return nil
+}
+
+//
+// Load the tunnels from a snapshot created by Client.Snapshot. The tunnels
+// aren't bound to any client.
+//
+func LoadSnapshot(snapshot []byte) (tunnels []Tunnel, err error) {
+	if err = json.Unmarshal(snapshot, &tunnels); err != nil {
+		return nil, fmt.Errorf("couldn't decode snapshot: %s", err)
+	}
+
+	return
+}
+
+func (c *Client) List(opts ...Option) (ids []string, err error) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, state := range states {
+		ids = append(ids, state.Id)
+	}
+
+	return
+}
+
+//
+// Field to sort tunnels by, see Client.ListSorted
+//
+type SortField int
+
+const (
+	ByCreationTime SortField = iota
+	ByLastConnected
+	ByStatus
+	ByOwner
+)
+
+//
+// Return the tunnels sorted by `by`, in ascending order, or descending order
+// if `desc` is set. Tunnels with equal fields are sorted by id in the same
+// direction, so the order is stable across calls. Unknown timestamps are the
+// zero time: they come first in ascending order.
+//
+func (c *Client) ListSorted(by SortField, desc bool, opts ...Option) (
+	tunnels []Tunnel, err error,
+) {
+	if tunnels, err = c.ListTunnels(opts...); err != nil {
+		return
+	}
+
+	var compare = func(a, b *Tunnel) int {
+		switch by {
+		case ByCreationTime:
+			return a.CreationTime.Compare(b.CreationTime)
+		case ByLastConnected:
+			return a.LastConnected.Compare(b.LastConnected)
+		case ByStatus:
+			return strings.Compare(a.State, b.State)
+		case ByOwner:
+			return strings.Compare(a.Owner, b.Owner)
+		default:
+			return 0
+		}
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		var a, b = &tunnels[i], &tunnels[j]
+		if desc {
+			a, b = b, a
+		}
+		if order := compare(a, b); order != 0 {
+			return order < 0
+		}
+		return a.Id < b.Id
+	})
+
+	return
+}
+
+//
+// Filters of Client.Query
+//
+type QueryOptions struct {
+	// Only return tunnels with this status if not empty. It's sent to the
+	// REST API, and checked again on the client in case the server ignores
+	// it.
+	Status string
+	// Query the details of the tunnels. Without it, the REST API only returns
+	// their ids: the tunnels only have their Id, and Status can only be
+	// checked by the server.
+	Full bool
+	// Only return the tunnels for which it returns true if not nil, checked
+	// on the client. The details are needed to check it, so it implies Full.
+	Predicate func(Tunnel) bool
+}
+
+//
+// Return the tunnels matching `query`: the coarse filters are applied by the
+// REST API to reduce the response, then Predicate by the client. Use List or
+// ListTunnels for all the tunnels.
+//
+func (c *Client) Query(query QueryOptions, opts ...Option) (
+	tunnels []Tunnel, err error,
+) {
+	var full = query.Full || query.Predicate != nil
+
+	var params = url.Values{}
+	if full {
+		params.Set("full", "1")
+	}
+	if query.Status != "" {
+		params.Set("status", query.Status)
+	}
+	var u = fmt.Sprintf("%s/%s/tunnels", c.BaseURL, c.Username)
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	if !full {
+		var ids []string
+		if err = c.executeRequest("GET", u, nil, &ids, opts...); err != nil {
+			return
+		}
+		for _, id := range ids {
+			tunnels = append(tunnels, Tunnel{Client: c, Id: id})
+		}
+		return
+	}
+
+	var states []tunnelState
+	if err = c.executeRequest("GET", u, nil, &states, opts...); err != nil {
+		return
+	}
+	for i := range states {
+		var tunnel = states[i].tunnel(c)
+		if query.Status != "" && tunnel.State != query.Status {
+			continue
+		}
+		if query.Predicate != nil && !query.Predicate(tunnel) {
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+
+	return
+}
+
+//
+// Tunnel concurrency limits of the account, see Client.ConcurrencyLimits
+//
+type Limits struct {
+	// Maximum number of concurrent tunnels, 0 if unknown
+	MaxTunnels int
+	// Number of tunnels currently used by the account
+	ActiveTunnels int
+}
+
+//
+// Return the maximum number of concurrent tunnels for the account, and the
+// number of tunnels in use. Tunnels count against the limit as soon as they're
+// created, so booting tunnels are included in ActiveTunnels, and stop counting
+// once they're down, in error or shutting down.
+//
+// The maximum comes from Client.MaxTunnels since the REST API doesn't expose
+// it.
+//
+func (c *Client) ConcurrencyLimits(opts ...Option) (
+	limits Limits, err error,
+) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	limits.MaxTunnels = c.MaxTunnels
+	for _, state := range states {
+		if !isTerminal(state.Status) {
+			limits.ActiveTunnels += 1
+		}
+	}
+
+	return
+}
+
+//
+// Report whether `n` more tunnels fit under the account's concurrency limit,
+// and how many tunnels can still be created. It fails when the limit is
+// unknown, i.e. Client.MaxTunnels isn't set.
+//
+func (c *Client) CanProvision(n int, opts ...Option) (
+	ok bool, available int, err error,
+) {
+	if c.MaxTunnels <= 0 {
+		return false, 0, errors.New(
+			"unknown concurrency limit, Client.MaxTunnels isn't set")
+	}
+
+	limits, err := c.ConcurrencyLimits(opts...)
+	if err != nil {
+		return
+	}
+
+	available = limits.MaxTunnels - limits.ActiveTunnels
+	if available < 0 {
+		available = 0
+	}
+	return n <= available, available, nil
+}
+
+//
+// Overview of the account's tunnels, see Client.FleetSummary
+//
+type FleetSummary struct {
+	Total int
+	// Tunnels by status: Booting counts new and booting tunnels, Failed
+	// tunnels in error, and Down the tunnels shutting down or shut down.
+	Running int
+	Booting int
+	Failed  int
+	Down    int
+	// Age of the oldest running tunnel, 0 without running tunnels
+	OldestAge time.Duration
+}
+
+//
+// Count the account's tunnels by status with a single query
+//
+func (c *Client) FleetSummary(opts ...Option) (*FleetSummary, error) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary FleetSummary
+	for i := range states {
+		var tunnel = states[i].tunnel(c)
+
+		summary.Total += 1
+		switch {
+		case tunnel.State == "running":
+			summary.Running += 1
+			if age := tunnel.Age(); age > summary.OldestAge {
+				summary.OldestAge = age
+			}
+		case tunnel.State == "error":
+			summary.Failed += 1
+		case isTerminal(tunnel.State):
+			summary.Down += 1
+		default:
+			summary.Booting += 1
+		}
+	}
+
+	return &summary, nil
+}
+
+//
+// Tunnel with its health, see Client.ListWithHealth
+//
+type TunnelHealth struct {
+	Tunnel
+	Healthy bool
+	// Why the tunnel is unhealthy, or "booting" for a healthy tunnel that
+	// isn't running yet
+	Reason string
+}
+
+//
+// Return the account's tunnels with their health: tunnels in error or down
+// are unhealthy, booting tunnels are unhealthy once they're older than
+// Client.MaxBootTime, and running tunnels once no client connected to them
+// for Client.MaxIdleTime.
+//
+func (c *Client) ListWithHealth(opts ...Option) ([]TunnelHealth, error) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var list = make([]TunnelHealth, len(states))
+	for i := range states {
+		var tunnel = states[i].tunnel(c)
+		list[i] = TunnelHealth{Tunnel: tunnel, Healthy: true}
+
+		switch {
+		case tunnel.State == "error":
+			list[i].Healthy, list[i].Reason = false, "error"
+		case isTerminal(tunnel.State):
+			list[i].Healthy, list[i].Reason = false, "down"
+		case tunnel.State != "running":
+			if tunnel.Age() > c.maxBootTime() {
+				list[i].Healthy, list[i].Reason = false, "failed to boot"
+			} else {
+				list[i].Reason = "booting"
+			}
+		default:
+			if tunnel.IdleDuration() > c.maxIdleTime() {
+				list[i].Healthy, list[i].Reason = false, "idle too long"
+			}
+		}
+	}
+
+	return list, nil
+}
+
+//
+// Return the tunnels whose Sauce Connect client runs on a platform containing
+// `substr`, ignoring case, for example "linux" or "windows". The platform is
+// the one reported in the tunnel's metadata.
+//
+func (c *Client) ListByPlatform(substr string, opts ...Option) (
+	matches []Tunnel, err error,
+) {
+	list, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	substr = strings.ToLower(substr)
+	for _, state := range list {
+		var platform = strings.ToLower(state.Metadata.Platform)
+		if strings.Contains(platform, substr) {
+			matches = append(matches, state.tunnel(c))
+		}
+	}
+
+	return
+}
+
+//
+// Return the tunnels labeled with `key` set to `value`
+//
+func (c *Client) ListByLabel(key, value string, opts ...Option) (
+	matches []Tunnel, err error,
+) {
+	list, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, state := range list {
+		if v, ok := state.Metadata.Labels[key]; ok && v == value {
+			matches = append(matches, state.tunnel(c))
+		}
+	}
+
+	return
+}
+
+//
+// Return the ids of the tunnels with `identifier` that aren't down
+//
+func (c *Client) activeTunnels(identifier string, opts ...Option) (
+	ids []string, err error,
+) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, s := range states {
+		if s.TunnelIdentifier == identifier && !isTerminal(s.Status) {
+			ids = append(ids, s.Id)
+		}
+	}
+	return
+}
+
+//
+// Shut down all the tunnels with `identifier`, and wait until they're all
+// down, polling every `poll`. The shutdown errors are joined together, and
+// returned along with ctx.Err() if the tunnels are still up when `ctx` is
+// done.
+//
+func (c *Client) DrainIdentifier(
+	ctx context.Context,
+	identifier string,
+	poll time.Duration,
+) error {
+	ids, err := c.activeTunnels(identifier, WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, id := range ids {
+		if _, err := c.Shutdown(id, WithContext(ctx)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var clock = c.getClock()
+	for {
+		ids, err := c.activeTunnels(identifier, WithContext(ctx))
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if len(ids) == 0 {
+			return errors.Join(errs...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(append(errs, fmt.Errorf(
+				"Tunnels %s aren't down: %w",
+				strings.Join(ids, ", "), ctx.Err()))...)
+		case <-clock.After(poll):
+		}
+	}
+}
+
+//
+// Return the tunnels running a Sauce Connect build older than `minBuild`,
+// according to their metadata. Tunnels without a valid build number are
+// returned too, since they can't be proven up to date. Tunnels already down
+// are ignored.
+//
+func (c *Client) FindOutdated(minBuild int, opts ...Option) (
+	outdated []Tunnel, err error,
+) {
+	tunnels, err := c.ListTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		if isTerminal(tunnel.State) {
+			continue
+		}
+		if build, err := tunnel.Metadata.BuildNumber(); err != nil ||
+			build < minBuild {
+			outdated = append(outdated, tunnel)
+		}
+	}
+
+	return
+}
+
+//
+// Return the tunnels whose identifier isn't in `activeIdentifiers`, for
+// example to shut down the tunnels of CI jobs that are finished. Tunnels
+// without identifier are only returned if `includeUnnamed` is true. Tunnels
+// already down are ignored.
+//
+func (c *Client) FindOrphans(
+	activeIdentifiers []string,
+	includeUnnamed bool,
+	opts ...Option,
+) (orphans []Tunnel, err error) {
+	tunnels, err := c.ListTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	var active = make(map[string]bool)
+	for _, identifier := range activeIdentifiers {
+		active[identifier] = true
+	}
+
+	for _, tunnel := range tunnels {
+		switch {
+		case isTerminal(tunnel.State):
+		case tunnel.TunnelIdentifier == "":
+			if includeUnnamed {
+				orphans = append(orphans, tunnel)
+			}
+		case !active[tunnel.TunnelIdentifier]:
+			orphans = append(orphans, tunnel)
+		}
+	}
+
+	return
+}
+
+//
+// Returned when no tunnel matched a query
+//
+var ErrNoMatchingTunnel = errors.New("no matching tunnel")
+
+//
+// Returned by FindTunnelForDomain when several running tunnels serve the
+// domain
+//
+var ErrAmbiguousDomain = errors.New("domain served by several tunnels")
+
+//
+// Return true if `pattern`, a domain of a tunnel, matches `domain`. Domains
+// are case-insensitive, and "*.example.com" matches the subdomains of
+// example.com.
+//
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(domain)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(domain, "."+suffix)
+	}
+	return pattern == domain
+}
+
+//
+// Return the running tunnel serving `domain`. Fail with ErrNoMatchingTunnel if
+// none does, and with ErrAmbiguousDomain if several do.
+//
+func (c *Client) FindTunnelForDomain(domain string, opts ...Option) (
+	*Tunnel, error,
+) {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Tunnel
+	for i := range states {
+		if states[i].Status != "running" {
+			continue
+		}
+		for _, pattern := range states[i].DomainNames {
+			if matchDomain(pattern, domain) {
+				matches = append(matches, states[i].tunnel(c))
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w for domain %s", ErrNoMatchingTunnel, domain)
+	case 1:
+		return &matches[0], nil
+	default:
+		var ids []string
+		for _, tunnel := range matches {
+			ids = append(ids, tunnel.Id)
+		}
+		return nil, fmt.Errorf(
+			"%w: %s is served by %s",
+			ErrAmbiguousDomain, domain, strings.Join(ids, ", "))
+	}
+}
+
+//
+// Strategy to select a tunnel among several, see Client.PickTunnel
+//
+type SelectStrategy int
+
+const (
+	// Most recently created tunnel
+	Newest SelectStrategy = iota
+	// Least recently created tunnel
+	Oldest
+	// Tunnel whose KGP client connected most recently
+	MostRecentlyConnected
+)
+
+//
+// Return true if `a` should be picked over `b` according to `strategy`
+//
+func (strategy SelectStrategy) prefer(a, b *Tunnel) bool {
+	var x, y time.Time
+	switch strategy {
+	case Newest:
+		x, y = a.CreationTime, b.CreationTime
+	case Oldest:
+		x, y = b.CreationTime, a.CreationTime
+	case MostRecentlyConnected:
+		x, y = a.LastConnected, b.LastConnected
+	}
+
+	if x.Equal(y) {
+		// Break ties with the id so the selection is deterministic
+		return a.Id < b.Id
+	}
+	return x.After(y)
+}
+
+//
+// Find the running tunnels matching `name` or `domains` like Find does, and
+// select one of them according to `strategy`. Return ErrNoMatchingTunnel if
+// no running tunnel matched.
+//
+func (c *Client) PickTunnel(
+	name string,
+	domains []string,
+	strategy SelectStrategy,
+	opts ...Option,
+) (*Tunnel, error) {
+	matches, err := c.FindTunnels(name, domains, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Tunnel
+	for i := range matches {
+		var tunnel = &matches[i]
+		if tunnel.State != "running" {
+			continue
+		}
+		if best == nil || strategy.prefer(tunnel, best) {
+			best = tunnel
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoMatchingTunnel
+	}
+	return best, nil
+}
+
+// How long Client.AccountDefaults caches the defaults
+const accountDefaultsTTL = time.Minute
+
+//
+// Return a template request with the account's usual tunnel options, to tweak
+// before creating a tunnel. The REST API doesn't expose account defaults, so
+// they're taken from the most recently created tunnel: the direct and no SSL
+// bump domains, fast fail regexps, proxy caching, sharing, VM version, and KGP
+// settings. The identifier and domains identify a tunnel, they're left empty.
+// Without tunnels, it's an empty request.
+//
+// The defaults are cached for a minute. Each call returns a new copy.
+//
+func (c *Client) AccountDefaults(opts ...Option) (*Request, error) {
+	var state = c.getState()
+	var clock = c.getClock()
+
+	state.defaultsMutex.Lock()
+	defer state.defaultsMutex.Unlock()
+
+	if state.defaults == nil || !clock.Now().Before(state.defaultsExpires) {
+		states, err := c.listTunnels(opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		var latest *Tunnel
+		for i := range states {
+			var tunnel = states[i].tunnel(c)
+			if latest == nil || Newest.prefer(&tunnel, latest) {
+				latest = &tunnel
+			}
+		}
+
+		var defaults Request
+		if latest != nil {
+			defaults = latest.requestDefaults()
+		}
+		state.defaults = &defaults
+		state.defaultsExpires = clock.Now().Add(accountDefaultsTTL)
+	}
+
+	var defaults = *state.defaults
+	defaults.DirectDomains = slices.Clone(defaults.DirectDomains)
+	defaults.NoSSLBumpDomains = slices.Clone(defaults.NoSSLBumpDomains)
+	defaults.FastFailRegexps = slices.Clone(defaults.FastFailRegexps)
+	if defaults.UseKGP != nil {
+		var useKGP = *defaults.UseKGP
+		defaults.UseKGP = &useKGP
+	}
+	return &defaults, nil
+}
+
+//
+// Return the options of the tunnel that aren't part of its identity as a
+// request, see Client.AccountDefaults
+//
+func (t *Tunnel) requestDefaults() Request {
+	var useKGP = t.UseKGP
+	var request = Request{
+		KGPPort: t.KGPPort,
+		UseKGP:  &useKGP,
+	}
+
+	json.Unmarshal(t.Extra["direct_domains"], &request.DirectDomains)
+	json.Unmarshal(t.Extra["no_ssl_bump_domains"], &request.NoSSLBumpDomains)
+	json.Unmarshal(t.Extra["fast_fail_regexps"], &request.FastFailRegexps)
+	json.Unmarshal(t.Extra["no_proxy_caching"], &request.NoProxyCaching)
+	json.Unmarshal(t.Extra["shared_tunnel"], &request.SharedTunnel)
+	json.Unmarshal(t.Extra["vm_version"], &request.VMVersion)
+
+	return request
+}
+
+//
+// Return a key identifying a tunnel by its identifier and its domains,
+// independently of the order of the domains.
+//
+func identityKey(identifier string, domains []string) string {
+	var sorted = append([]string(nil), domains...)
+	sort.Strings(sorted)
+
+	return identifier + "\x00" + strings.Join(sorted, "\x00")
+}
+
+//
+// Compare the `desired` tunnels with the `actual` tunnels, tunnels are
+// identified by their TunnelIdentifier and DomainNames: the other fields, like
+// the metadata, are ignored. Return the desired tunnels missing from `actual`,
+// the actual tunnels that aren't desired, and the actual tunnels matching a
+// desired tunnel.
+//
+// Each actual tunnel matches at most one desired tunnel, so duplicates in
+// `actual` are returned in `toShutdown`. Actual tunnels that are already down
+// are ignored.
+//
+func DiffTunnels(desired, actual []Tunnel) (
+	toCreate, toShutdown, unchanged []Tunnel,
+) {
+	var available = make(map[string][]Tunnel)
+	for _, tunnel := range actual {
+		if isTerminal(tunnel.State) {
+			continue
+		}
+		var key = identityKey(tunnel.TunnelIdentifier, tunnel.DomainNames)
+		available[key] = append(available[key], tunnel)
+	}
+
+	for _, tunnel := range desired {
+		var key = identityKey(tunnel.TunnelIdentifier, tunnel.DomainNames)
+		if matches := available[key]; len(matches) > 0 {
+			unchanged = append(unchanged, matches[0])
+			available[key] = matches[1:]
+		} else {
+			toCreate = append(toCreate, tunnel)
+		}
+	}
+
+	// Iterate over `actual` rather than the map to keep its order
+	for _, tunnel := range actual {
+		var key = identityKey(tunnel.TunnelIdentifier, tunnel.DomainNames)
+		var matches = available[key]
+		if len(matches) > 0 && matches[0].Id == tunnel.Id {
+			toShutdown = append(toShutdown, tunnel)
+			available[key] = matches[1:]
+		}
+	}
+
+	return
+}
+
+// Number of tunnels Reconcile creates or shuts down at the same time
+const reconcileConcurrency = 4
+
+//
+// Converge the account's tunnels to `desired`: list the tunnels, compare them
+// with `desired` like DiffTunnels, create the missing tunnels and shut down
+// the ones that aren't desired. Return the tunnels created and the ids of the
+// tunnels shut down, even if some operations failed: the errors of all the
+// operations are joined in `err`.
+//
+// See ReconcileWithReport to bound the whole operation with a deadline.
+//
+func (c *Client) Reconcile(ctx context.Context, desired []*Request) (
+	created []*Tunnel, shutdown []string, err error,
+) {
+	report, err := c.ReconcileWithReport(ctx, desired, false)
+	if report != nil {
+		created, shutdown = report.Created, report.Shutdown
+	}
+	return
+}
+
+//
+// Outcome of Client.ReconcileWithReport. Requests are identified by their
+// index in `desired`, and tunnels to shut down by their id.
+//
+type ReconcileReport struct {
+	// Tunnels created, and tunnels shut down because they weren't desired
+	Created  []*Tunnel
+	Shutdown []string
+
+	// Operations that failed, and operations abandoned because the context
+	// was done
+	Failed             map[int]error
+	ShutdownFailed     map[string]error
+	Abandoned          []int
+	AbandonedShutdowns []string
+
+	// Tunnels created by abandoned requests before they were abandoned, and
+	// still booting. They're shut down with the rollback.
+	Orphaned []string
+	// Tunnels shut down by the rollback
+	RolledBack []string
+}
+
+// How long the rollback of ReconcileWithReport may take after the deadline
+const rollbackTimeout = time.Minute
+
+//
+// Same as Reconcile, with a report of every operation. `ctx` is the budget of
+// the whole operation: once it's done, the operations in progress are
+// aborted, and the ones that didn't start are abandoned. If `rollback` is set
+// and `ctx` is done before the end, the tunnels created so far are shut down
+// instead of being returned in Created, within rollbackTimeout.
+//
+// The returned error joins the errors of the failed and abandoned operations.
+//
+func (c *Client) ReconcileWithReport(
+	ctx context.Context,
+	desired []*Request,
+	rollback bool,
+) (*ReconcileReport, error) {
+	states, err := c.listTunnels(WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var actual = make([]Tunnel, len(states))
+	for i := range states {
+		actual[i] = states[i].tunnel(c)
+	}
+	// The id of the desired tunnels is the index of their request
+	var wanted = make([]Tunnel, len(desired))
+	for i, r := range desired {
+		wanted[i] = Tunnel{
+			Id:               strconv.Itoa(i),
+			TunnelIdentifier: r.TunnelIdentifier,
+			DomainNames:      r.DomainNames,
+		}
+	}
+	toCreate, toShutdown, _ := DiffTunnels(wanted, actual)
+
+	var report = ReconcileReport{
+		Failed:         make(map[int]error),
+		ShutdownFailed: make(map[string]error),
+	}
+	var errs []error
+	var indexes []int
+	var requests []*Request
+	for _, tunnel := range toCreate {
+		var i, _ = strconv.Atoi(tunnel.Id)
+		indexes = append(indexes, i)
+		requests = append(requests, desired[i])
+	}
+	for event := range c.CreateStream(ctx, requests, reconcileConcurrency) {
+		var i = indexes[event.Index]
+		switch {
+		case event.Err == nil:
+			report.Created = append(report.Created, event.Tunnel)
+			continue
+		case ctx.Err() != nil && errors.Is(event.Err, ctx.Err()):
+			report.Abandoned = append(report.Abandoned, i)
+			if event.TunnelId != "" {
+				report.Orphaned = append(report.Orphaned, event.TunnelId)
+			}
+		default:
+			report.Failed[i] = event.Err
+		}
+		errs = append(errs, event.Err)
+	}
+
+	var ids []string
+	for _, tunnel := range toShutdown {
+		ids = append(ids, tunnel.Id)
+	}
+	var results = c.ShutdownMany(ctx, ids, reconcileConcurrency)
+	for _, id := range ids {
+		var err = results[id]
+		switch {
+		case err == nil:
+			report.Shutdown = append(report.Shutdown, id)
+			continue
+		case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+			report.AbandonedShutdowns = append(report.AbandonedShutdowns, id)
+		default:
+			report.ShutdownFailed[id] = err
+		}
+		errs = append(errs, err)
+	}
+
+	if rollback && ctx.Err() != nil {
+		var ids = report.Orphaned
+		for _, tunnel := range report.Created {
+			ids = append(ids, tunnel.Id)
+		}
+
+		rollbackCtx, cancel := context.WithTimeout(
+			context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		var results = c.ShutdownMany(rollbackCtx, ids, reconcileConcurrency)
+
+		var kept []*Tunnel
+		for _, tunnel := range report.Created {
+			if results[tunnel.Id] != nil {
+				kept = append(kept, tunnel)
+			}
+		}
+		report.Created = kept
+		for _, id := range ids {
+			if err := results[id]; err != nil {
+				errs = append(errs, err)
+			} else {
+				report.RolledBack = append(report.RolledBack, id)
+			}
+		}
+	}
+
+	sort.Ints(report.Abandoned)
+	sort.Strings(report.Shutdown)
+	sort.Strings(report.AbandonedShutdowns)
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.RolledBack)
+	return &report, errors.Join(errs...)
+}
+
+//
+// Shut down the tunnels `ids`, `concurrency` at a time, and return the result
+// of each shutdown indexed by id: nil if the tunnel was shut down or didn't
+// exist. When `ctx` is done the shutdowns in progress are aborted, and the
+// ones that weren't started fail with ctx.Err().
+//
+func (c *Client) ShutdownMany(
+	ctx context.Context,
+	ids []string,
+	concurrency int,
+) map[string]error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var results = make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var slots = make(chan struct{}, concurrency)
+
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			var err error
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case slots <- struct{}{}:
+				if err = ctx.Err(); err == nil {
+					_, err = c.Shutdown(id, WithContext(ctx))
+				}
+				<-slots
+			}
+
+			if errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[id] = err
+		}(id)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func checkOverlappingDomains(localDomains []string, remoteDomains []string) bool {
+	for _, localDomain := range localDomains {
+		for _, remoteDomain := range remoteDomains {
+			if localDomain == remoteDomain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Find tunnels: named tunnel with `name`, or tunnel matching one or more of
+// `domains`.
+//
+func (c *Client) Find(name string, domains []string, opts ...Option) (
+	matches []string, err error,
+) {
+	tunnels, err := c.FindTunnels(name, domains, opts...)
+	if err != nil {
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		matches = append(matches, tunnel.Id)
+	}
+
+	return
+}
+
+//
+// Same as Find, but return the matching tunnels with their details instead of
+// their ids. The details come from the same list query, so no extra request is
+// made per tunnel.
+//
+func (c *Client) FindTunnels(name string, domains []string, opts ...Option) (
+	matches []Tunnel, err error,
+) {
+	list, err := c.listTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	for _, state := range list {
+		if name != "" && state.TunnelIdentifier == name {
+			matches = append(matches, state.tunnel(c))
+			continue
+		}
+
+		if checkOverlappingDomains(domains, state.DomainNames) {
+			matches = append(matches, state.tunnel(c))
+		}
+	}
+
+	return
+}
+
+//
+// Shutdown tunnel `id`
+//
+// The REST API can't pause a tunnel: a tunnel keeps its slot until it's shut
+// down, and stopping the traffic means shutting it down. To hold capacity
+// between test runs, keep the tunnel running and stop sending jobs to it.
+//
+func (c *Client) Shutdown(id string, opts ...Option) (int, error) {
+	return c.shutdown("%s/%s/tunnels/%s", id, opts...)
+}
+
+//
+// Abort the creation of tunnel `id`: a tunnel still new or booting is shut
+// down right away, there can't be jobs using it yet. A tunnel that already
+// came up is shut down with Shutdown, and nothing is done for a tunnel that's
+// already down.
+//
+func (c *Client) CancelCreate(id string, opts ...Option) error {
+	status, err := c.Status(id, opts...)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isTerminal(status):
+		return nil
+	case status == "running":
+		_, err = c.Shutdown(id, opts...)
+	default:
+		_, err = c.shutdown(
+			"%s/%s/tunnels/%s?wait_for_jobs=0", id, opts...)
+	}
+
+	return err
+}
+
+func (c *Client) shutdown(urlFmt, id string, opts ...Option) (int, error) {
+	var url = fmt.Sprintf(urlFmt, c.BaseURL, c.Username, id)
+
+	var response struct {
+		JobsRunning int `json:"jobs_running"`
+	}
+	err := c.executeRequest("DELETE", url, nil, &response, opts...)
+	jobsRunning := response.JobsRunning
+	if err == nil {
+		c.emit(id, "shutdown", "", nil)
+	}
+
+	return jobsRunning, err
+}
+
+type Metadata struct {
+	Release     string `json:"release" yaml:"release"`
+	GitVersion  string `json:"git_version" yaml:"git_version"`
+	Build       string `json:"build" yaml:"build"`
+	Platform    string `json:"platform" yaml:"platform"`
+	Hostname    string `json:"hostname" yaml:"hostname"`
+	NoFileLimit uint64 `json:"nofile_limit" yaml:"nofile_limit"`
+	Command     string `json:"command" yaml:"command"`
+}
+
+//
+// Parse the Sauce Connect build number reported in the metadata
+//
+func (m Metadata) BuildNumber() (int, error) {
+	var build, err = strconv.Atoi(m.Build)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Sauce Connect build %q", m.Build)
+	}
+
+	return build, nil
+}
+
+//
+// The REST API doesn't support labels on tunnels, so we store them in the
+// metadata object under the reserved key "labels": the metadata is stored and
+// returned as-is by the REST API.
+//
+type jsonMetadata struct {
+	Metadata
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+//
+// Decode the metadata object, the build number is sent as a string by some
+// versions of Sauce Connect and as a number by others.
+//
+func (m *jsonMetadata) UnmarshalJSON(data []byte) error {
+	type plainMetadata jsonMetadata
+	var v struct {
+		plainMetadata
+		Build json.RawMessage `json:"build"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*m = jsonMetadata(v.plainMetadata)
+	m.Build = ""
+	if len(v.Build) == 0 || string(v.Build) == "null" {
+		return nil
+	}
+	if v.Build[0] == '"' {
+		return json.Unmarshal(v.Build, &m.Build)
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(v.Build, &number); err != nil {
+		return fmt.Errorf("invalid metadata build: %s", err)
+	}
+	m.Build = number.String()
+
+	return nil
+}
+
+type jsonRequest struct {
+	TunnelIdentifier *string      `json:"tunnel_identifier"`
+	DomainNames      []string     `json:"domain_names"`
+	Metadata         jsonMetadata `json:"metadata"`
+	SSHPort          int          `json:"ssh_port"`
+	NoProxyCaching   bool         `json:"no_proxy_caching"`
+	UseKGP           bool         `json:"use_kgp"`
+	FastFailRegexps  *[]string    `json:"fast_fail_regexps"`
+	DirectDomains    *[]string    `json:"direct_domains"`
+	SharedTunnel     bool         `json:"shared_tunnel"`
+	SquidConfig      *string      `json:"squid_config"`
+	VMVersion        *string      `json:"vm_version"`
+	NoSSLBumpDomains *[]string    `json:"no_ssl_bump_domains"`
+	ExtraInfo        *string      `json:"extra_info"`
+}
+
+//
+// Request for a new tunnel
+//
+type Request struct {
+	TunnelIdentifier string
+	DomainNames      []string
+
+	DirectDomains    []string
+	KGPPort          int
+	NoProxyCaching   bool
+	FastFailRegexps  []string
+	SharedTunnel     bool
+	VMVersion        string
+	NoSSLBumpDomains []string
+
+	// Use the KGP protocol to connect the Sauce Connect client to the tunnel
+	// VM. Only legacy setups should disable KGP: the tunnel then expects a
+	// client speaking the older SSH-based protocol. nil means the default,
+	// which is KGP.
+	UseKGP *bool
+
+	// Metadata stored with the tunnel and returned as-is by the REST API.
+	// Metadata.Command is sent verbatim: redact secrets like the access key
+	// before setting it.
+	Metadata Metadata
+
+	// Arbitrary key/value pairs to organize tunnels, see Client.ListByLabel.
+	// The REST API has no tags, so labels are the way to tag tunnels, for
+	// example with a cost center or a project to bill their usage back.
+	Labels map[string]string
+
+	// Return the new tunnel as soon as it's created, without waiting for it
+	// to come up. Use Client.WaitForStatus to wait for it.
+	NoWait bool
+
+	// Decide when the new tunnel is ready, instead of waiting for its status
+	// to be "running". It's called with the tunnel's details after each
+	// status query. For example, wait for a Sauce Connect client to connect
+	// with:
+	//
+	//	func(t *Tunnel) bool { return !t.LastConnected.IsZero() }
+	ReadyWhen func(tunnel *Tunnel) bool
+
+	// Allow creating a tunnel without DomainNames, see Validate
+	AllowNoDomains bool
+
+	// Fail with an *IdentifierInUseError instead of creating the tunnel if
+	// a tunnel with the same TunnelIdentifier is already up or booting. The
+	// REST API doesn't enforce it: two clients creating a tunnel with the
+	// same identifier at the same time may both create it. It requires a
+	// TunnelIdentifier, see Validate.
+	UniqueIdentifier bool
+
+	// Called before creating a tunnel that isn't shared when a compatible
+	// shared tunnel is already running, see Warning. The tunnel is created
+	// anyway. Nothing is checked if it's nil, since the check lists all the
+	// tunnels of the account.
+	OnWarning func(Warning)
+
+	// Called once when the tunnel is still not running SlowCreateAfter after
+	// the creation started, with the time elapsed and the last status of the
+	// tunnel. It's only a warning, the creation goes on until its timeout.
+	// Disabled if either field is zero.
+	SlowCreateAfter time.Duration
+	OnSlowCreate    func(elapsed time.Duration, lastStatus string)
+
+	// URL to post a WebhookPayload to once the tunnel is running or the
+	// creation failed, with the client's http.Client. It's posted by the
+	// client, before Create returns, not by Sauce Labs. Failures are logged
+	// with Client.Logf but don't fail the creation.
+	ReadyWebhook string
+
+	// Region or VM pool to run the tunnel in. The REST API doesn't support
+	// it: tunnels run in the data center of Client.BaseURL, and there's no
+	// way to pick a pool. Validate rejects requests setting it with
+	// ErrRegionHintUnsupported, rather than ignoring it.
+	RegionHint string
+
+	// Extra info. This is a string (which contains a JSON dict) to enable
+	// optional features and flags.
+	ExtraInfo string
+}
+
+//
+// Returned by Request.Validate when a request has no domain names
+//
+var ErrNoDomains = errors.New("tunnel request has no domain names")
+
+//
+// Non-fatal issue with a creation request, see Request.OnWarning. TunnelId is
+// the existing shared tunnel with the same identifier and domains as the
+// request: using it instead would save a tunnel.
+//
+type Warning struct {
+	Message  string
+	TunnelId string
+}
+
+//
+// Call request.OnWarning for the running shared tunnels compatible with
+// `request`. Failing to list the tunnels isn't an error, it's only a warning.
+//
+func (c *Client) warnSharedDuplicates(request *Request, opts ...Option) {
+	tunnels, err := c.ListTunnels(opts...)
+	if err != nil {
+		return
+	}
+
+	var key = identityKey(request.TunnelIdentifier, request.DomainNames)
+	for _, tunnel := range tunnels {
+		var shared bool
+		json.Unmarshal(tunnel.Extra["shared_tunnel"], &shared)
+		if !shared || tunnel.State != "running" ||
+			identityKey(tunnel.TunnelIdentifier, tunnel.DomainNames) != key {
+			continue
+		}
+		request.OnWarning(Warning{
+			Message: fmt.Sprintf(
+				"shared tunnel %s owned by %s serves the same domains",
+				tunnel.Id, tunnel.Owner),
+			TunnelId: tunnel.Id,
+		})
+	}
+}
+
+//
+// Returned by Request.Validate when Request.RegionHint is set
+//
+var ErrRegionHintUnsupported = errors.New(
+	"region hints aren't supported, tunnels run in the region of the base URL")
+
+//
+// Returned by Request.Validate when Request.UniqueIdentifier is set without a
+// TunnelIdentifier
+//
+var ErrNoIdentifier = errors.New(
+	"unique identifier requested without a tunnel identifier")
+
+//
+// Matched by errors.Is for an *IdentifierInUseError
+//
+var ErrIdentifierInUse = errors.New("tunnel identifier in use")
+
+//
+// Returned by Create for a request with UniqueIdentifier when the tunnel
+// TunnelId already uses the identifier.
+//
+type IdentifierInUseError struct {
+	Identifier string
+	TunnelId   string
+}
+
+func (e *IdentifierInUseError) Error() string {
+	return fmt.Sprintf(
+		"%s: %q is used by tunnel %s",
+		ErrIdentifierInUse, e.Identifier, e.TunnelId)
+}
+
+func (e *IdentifierInUseError) Is(target error) bool {
+	return target == ErrIdentifierInUse
+}
+
+//
+// Return an error if a tunnel that isn't down uses `identifier`
+//
+func (c *Client) checkIdentifier(identifier string, opts ...Option) error {
+	states, err := c.listTunnels(opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range states {
+		if s.TunnelIdentifier == identifier && !isTerminal(s.Status) {
+			return &IdentifierInUseError{identifier, s.Id}
+		}
+	}
+
+	return nil
+}
+
+//
+// Returned by Request.Validate when a domain name is malformed
+//
+var ErrInvalidDomain = errors.New("invalid domain name")
+
+//
+// Returned by Request.Validate with the malformed domain and what's wrong with
+// it. It matches ErrInvalidDomain with errors.Is.
+//
+type InvalidDomainError struct {
+	Domain string
+	Reason string
+}
+
+func (e *InvalidDomainError) Error() string {
+	return fmt.Sprintf("%s %q: %s", ErrInvalidDomain, e.Domain, e.Reason)
+}
+
+func (e *InvalidDomainError) Is(target error) bool {
+	return target == ErrInvalidDomain
+}
+
+//
+// Check that `domain` is a hostname as defined by RFC 1123, optionally
+// prefixed with "*." to match its subdomains. Return why it isn't, or an
+// empty string.
+//
+func checkDomain(domain string) string {
+	var name = strings.TrimPrefix(domain, "*.")
+
+	switch {
+	case name == "":
+		return "empty name"
+	case len(name) > 253:
+		return "longer than 253 characters"
+	case strings.Contains(name, "*"):
+		return "wildcard must be the first label, as in *.example.com"
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		switch {
+		case label == "":
+			return "empty label"
+		case len(label) > 63:
+			return fmt.Sprintf("label %q longer than 63 characters", label)
+		case label[0] == '-' || label[len(label)-1] == '-':
+			return fmt.Sprintf("label %q starts or ends with a hyphen", label)
+		}
+
+		for _, char := range label {
+			if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' ||
+				char >= '0' && char <= '9' || char == '-') {
+				return fmt.Sprintf("invalid character %q", char)
+			}
+		}
+	}
+
+	return ""
+}
+
+//
+// Return a stable fingerprint of the tunnel the request creates, equal to
+// the Tunnel.Fingerprint of the tunnel. It covers TunnelIdentifier, the
+// DomainNames in any order, case, or with duplicates, SharedTunnel, and
+// UseKGP, nil being KGP.
+//
+func (r *Request) Fingerprint() string {
+	var useKGP = r.UseKGP == nil || *r.UseKGP
+	return fingerprint(r.TunnelIdentifier, r.DomainNames, r.SharedTunnel, useKGP)
+}
+
+//
+// Check the request before it's sent to the REST API.
+//
+// A request without DomainNames is refused unless AllowNoDomains is set: the
+// REST API creates a catch-all tunnel in that case, and every job without a
+// tunnel identifier may then send its traffic through it.
+//
+// Each domain must be a valid hostname, or a wildcard like "*.example.com".
+// Pseudo-domains like "sauce-connect.proxy" are valid hostnames too. A
+// malformed domain fails with an *InvalidDomainError.
+//
+// UniqueIdentifier can't be checked without a TunnelIdentifier: the tunnels
+// without one would all count as duplicates.
+//
+func (r *Request) Validate() error {
+	if len(r.DomainNames) == 0 && !r.AllowNoDomains {
+		return ErrNoDomains
+	}
+	for _, domain := range r.DomainNames {
+		if reason := checkDomain(domain); reason != "" {
+			return &InvalidDomainError{domain, reason}
+		}
+	}
+	if r.RegionHint != "" {
+		return ErrRegionHintUnsupported
+	}
+	if r.UniqueIdentifier && r.TunnelIdentifier == "" {
+		return ErrNoIdentifier
+	}
+
+	return nil
+}
+
+// Create a new tunnel and wait for it to come up within Client.CreateTimeout
+//
+// This will start a goroutine to keep track of the tunnel's status using the
+// ClientStatus & ServerStatus channels, unless request.NoWait is set.
+func (c *Client) Create(request *Request) (tunnel Tunnel, err error) {
+	return c.createAndTrack(request)
+}
+
+//
+// Same as Create, with the options of the call
+//
+func (c *Client) createAndTrack(request *Request, opts ...Option) (
+	tunnel Tunnel, err error,
+) {
+	tunnel, err = c.create(request, c.createTimeout(), opts...)
+
+	if err == nil && !request.NoWait {
+		go tunnel.serverStatusLoop(5 * time.Second)
+		go tunnel.heartbeatLoop(30 * time.Second)
+	}
+	return
+}
+
+//
+// Result of one of the requests passed to Client.CreateStream. Index is the
+// index of the request, Tunnel is nil if the creation failed with Err.
+//
+type CreateEvent struct {
+	Index  int
+	Tunnel *Tunnel
+	Err    error
+	// Id of the tunnel if the REST API created it, even if it then failed
+	// to come up
+	TunnelId string
+}
+
+//
+// Create a tunnel for each of `requests`, `concurrency` at a time, and send
+// an event on the returned channel as soon as each of them is up or failed.
+// The channel is closed once every request has an event.
+//
+// When `ctx` is done the creations in progress are aborted and the requests
+// that weren't started fail with ctx.Err(). The channel is buffered for all
+// the events, so the caller can stop reading from it at any time.
+//
+func (c *Client) CreateStream(
+	ctx context.Context,
+	requests []*Request,
+	concurrency int,
+) <-chan CreateEvent {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var events = make(chan CreateEvent, len(requests))
+	var slots = make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request *Request) {
+			defer wg.Done()
+
+			select {
+			case <-ctx.Done():
+				events <- CreateEvent{Index: i, Err: ctx.Err()}
+				return
+			case slots <- struct{}{}:
+			}
+			defer func() { <-slots }()
+
+			if ctx.Err() != nil {
+				events <- CreateEvent{Index: i, Err: ctx.Err()}
+				return
+			}
+
+			var tunnel, err = c.create(
+				request, c.createTimeout(), WithContext(ctx))
+			if err != nil {
+				events <- CreateEvent{Index: i, Err: err, TunnelId: tunnel.Id}
+				return
+			}
+			if !request.NoWait {
+				go tunnel.serverStatusLoop(5 * time.Second)
+				go tunnel.heartbeatLoop(30 * time.Second)
+			}
+			events <- CreateEvent{Index: i, Tunnel: &tunnel, TunnelId: tunnel.Id}
+		}(i, request)
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	return events
+}
+
+//
+// Returned by Create when the REST API answered the creation request
+// successfully, but without a tunnel in the response.
+//
+var ErrCreateRejected = errors.New("tunnel creation rejected")
+
+//
+// Returned by Create when the account can't start more tunnels: the REST API
+// refused the creation request with the status 429 Too Many Requests. The
+// original *APIError is wrapped too.
+//
+var ErrNoCapacity = errors.New("no tunnel capacity available")
+
+type createResponse struct {
+	tunnelState
+	Error json.RawMessage `json:"error"`
+}
+
+// Needed since tunnelState.UnmarshalJSON would be promoted otherwise, and
+// ignore Error
+func (r *createResponse) UnmarshalJSON(data []byte) error {
+	var errorField struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &errorField); err != nil {
+		return err
+	}
+	if err := r.tunnelState.UnmarshalJSON(data); err != nil {
+		return err
+	}
+
+	r.Error = errorField.Error
+	delete(r.Extra, "error")
+	if len(r.Extra) == 0 {
+		r.Extra = nil
+	}
+	return nil
+}
+
+//
+// Check the response describes a new tunnel, and not an error. The REST API
+// sometimes returns its errors with a 200 status code, polling for a tunnel
+// that was never created would only end in a confusing timeout.
+//
+func (r *createResponse) check() error {
+	if len(r.Error) > 0 && string(r.Error) != "null" {
+		var message string
+		if json.Unmarshal(r.Error, &message) != nil {
+			message = string(r.Error)
+		}
+		return fmt.Errorf("%w: %s", ErrCreateRejected, message)
+	}
+	if r.Id == "" || r.Status == "" {
+		return fmt.Errorf(
+			"%w: response doesn't describe a tunnel", ErrCreateRejected)
+	}
+
+	return nil
+}
+
+//
+// Create a new tunnel and wait for it to come up within `wait`. If
+// request.NoWait is set, return the new tunnel right away instead.
+//
+func (c *Client) CreateWithTimeout(
+	request *Request,
+	timeout time.Duration,
+) (
+	tunnel Tunnel, err error,
+) {
+	return c.create(request, timeout)
+}
+
+func (c *Client) create(
+	request *Request,
+	timeout time.Duration,
+	opts ...Option,
+) (
+	tunnel Tunnel, err error,
+) {
+	var r = request
+	if err = r.Validate(); err != nil {
+		return
+	}
+	if r.UniqueIdentifier {
+		if err = c.checkIdentifier(r.TunnelIdentifier, opts...); err != nil {
+			return
+		}
+	}
+	if r.OnWarning != nil && !r.SharedTunnel {
+		c.warnSharedDuplicates(r, opts...)
+	}
+
+	var clock = c.getClock()
+	var start = clock.Now()
+	var waited = false
+	defer func() {
+		c.recordCreate(err, waited, clock.Now().Sub(start))
+		if err != nil {
+			c.emit(tunnel.Id, "failed", tunnel.State, err)
+		}
+		if r.ReadyWebhook != "" && (waited || err != nil) {
+			var ctx, cancel = c.callContext(opts...)
+			defer cancel()
+			c.notifyWebhook(ctx, r.ReadyWebhook, tunnel, err)
+		}
+	}()
+
+	var useKGP = true
+	if r.UseKGP != nil {
+		useKGP = *r.UseKGP
+	}
+
+	var doc = jsonRequest{
+		TunnelIdentifier: &r.TunnelIdentifier,
+		DomainNames:      r.DomainNames,
+		Metadata:         jsonMetadata{r.Metadata, r.Labels},
+		SSHPort:          r.KGPPort,
+		NoProxyCaching:   r.NoProxyCaching,
+		UseKGP:           useKGP,
+		FastFailRegexps:  &r.FastFailRegexps,
+		DirectDomains:    &r.DirectDomains,
+		SharedTunnel:     r.SharedTunnel,
+		SquidConfig:      nil,
+		VMVersion:        &r.VMVersion,
+		NoSSLBumpDomains: &r.NoSSLBumpDomains,
+		ExtraInfo:        &r.ExtraInfo,
+	}
+	var response createResponse
+	var url = fmt.Sprintf("%s/%s/tunnels", c.BaseURL, c.Username)
+
+	err = c.executeRequest("POST", url, doc, &response, opts...)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusTooManyRequests {
+		err = fmt.Errorf("%w: %w", ErrNoCapacity, err)
+	}
+	if err != nil {
+		return
+	}
+	if err = response.check(); err != nil {
+		return
+	}
+
+	tunnel = response.tunnel(c)
+	c.emit(tunnel.Id, "created", tunnel.State, nil)
+	if r.NoWait {
+		return
+	}
+
+	waited = true
+	if r.ReadyWhen != nil {
+		opts = append(opts[:len(opts):len(opts)], withReadyCheck(r.ReadyWhen))
+	}
+	if r.OnSlowCreate != nil && r.SlowCreateAfter > 0 {
+		var warned = false
+		opts = append(opts[:len(opts):len(opts)], withPollHook(
+			func(polled Tunnel) {
+				var elapsed = clock.Now().Sub(start)
+				if !warned && elapsed >= r.SlowCreateAfter {
+					warned = true
+					r.OnSlowCreate(elapsed, polled.State)
+				}
+			}))
+	}
+	tunnel.Host, err = tunnel.wait(timeout, opts...)
+	// Only create channels if the tunnel succesfully come up
+	if err == nil {
+		tunnel.State = "running"
+		tunnel.ServerStatus = make(chan string)
+		tunnel.ClientStatus = make(chan ClientStatus)
+		c.emit(tunnel.Id, "running", tunnel.State, nil)
+	}
+	return
+}
+
+//
+// Return true if the REST API rejected the tunnel identifier: a 4xx error
+// whose JSON body names it in its `field`, or in its `code` like
+// "tunnel_identifier_unavailable". An identifier used by a live tunnel isn't
+// a rejection, see Request.UniqueIdentifier.
+//
+func isIdentifierRejected(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) ||
+		apiErr.StatusCode < 400 || apiErr.StatusCode >= 500 {
+		return false
+	}
+
+	var doc struct {
+		Code  string `json:"code"`
+		Field string `json:"field"`
+	}
+	if json.Unmarshal([]byte(apiErr.Message), &doc) != nil {
+		return false
+	}
+	return doc.Field == "tunnel_identifier" ||
+		strings.Contains(doc.Code, "tunnel_identifier")
+}
+
+//
+// Same as Create, but if the REST API rejects request's identifier, try again
+// once with a new identifier derived from it, like "web-1a2b3c4d". This
+// unblocks jobs when a tunnel identifier is stuck in a bad state on the
+// server. An *IdentifierInUseError isn't retried: the identifier belongs to
+// a live tunnel. Return the identifier of the tunnel, the one of the request or the
+// new one. If the second creation fails too, `identifier` is the new one, so
+// the caller can look for the tunnel it may have left behind.
+//
+func (c *Client) CreateWithFallbackIdentifier(
+	request *Request,
+	opts ...Option,
+) (
+	tunnel Tunnel, identifier string, err error,
+) {
+	identifier = request.TunnelIdentifier
+	tunnel, err = c.createAndTrack(request, opts...)
+	if err == nil || identifier == "" || !isIdentifierRejected(err) {
+		return
+	}
+
+	var suffix = make([]byte, 4)
+	if _, randErr := rand.Read(suffix); randErr != nil {
+		return
+	}
+
+	var fallback = *request
+	fallback.TunnelIdentifier = identifier + "-" + hex.EncodeToString(suffix)
+	tunnel, err = c.createAndTrack(&fallback, opts...)
+	if err != nil {
+		err = fmt.Errorf(
+			"Tunnel %s couldn't be created with identifier %s either: %w",
+			identifier, fallback.TunnelIdentifier, err)
+	}
+
+	return tunnel, fallback.TunnelIdentifier, err
+}
+
+//
+// Return a running tunnel serving one or more of request.DomainNames, or create
+// a new tunnel for `request` if there's none. `created` is true if the tunnel
+// was created, by Create: its status is tracked the same way.
+//
+// This isn't atomic: the REST API can't check and create in one operation, so
+// two clients claiming the same domains at the same time may both create a
+// tunnel. The window is the time between listing the tunnels and the creation
+// request, usually well under a second.
+//
+func (c *Client) ClaimDomains(request *Request) (
+	tunnel *Tunnel, created bool, err error,
+) {
+	tunnel, err = c.PickTunnel("", request.DomainNames, Oldest)
+	if err != ErrNoMatchingTunnel {
+		return tunnel, false, err
+	}
+
+	newTunnel, err := c.Create(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &newTunnel, true, nil
+}
+
+type ClientStatus struct {
+	Connected        bool
+	LastStatusChange int64
+}
+
+//
+// Tunnel control interface. Create it by calling Client.Create(), all methods
+// are safe to call across goroutines. Tunnel.Status() is updated every XXX
+// seconds by a goroutine that queries the state of the tunnel.
+//
+// We may want to switch the method Status with a direct access to the active
+// channel instead depending of how the main loop is done.
+//
+type Tunnel struct {
+	Client *Client `json:"-"`
+	Id     string  `json:"id"`
+	Host   string  `json:"host"`
+
+	// Tunnel details as reported by the REST API. Those are only filled by
+	// the methods querying tunnel details, like Client.GetTunnel or
+	// Client.FindTunnels.
+	TunnelIdentifier string            `json:"tunnel_identifier"`
+	DomainNames      []string          `json:"domain_names"`
+	State            string            `json:"status"`
+	Owner            string            `json:"owner"`
+	KGPPort          int               `json:"kgp_port"`
+	UseKGP           bool              `json:"use_kgp"`
+	Metadata         Metadata          `json:"metadata"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	// Timestamps are the zero time when they aren't set, for example
+	// LastConnected when the KGP client never connected.
+	CreationTime  time.Time `json:"creation_time"`
+	LaunchTime    time.Time `json:"launch_time"`
+	LastConnected time.Time `json:"last_connected"`
+	ShutdownTime  time.Time `json:"shutdown_time"`
+	// True if a user shut the tunnel down, false if the system did, nil if
+	// the REST API didn't say.
+	UserShutdown *bool `json:"user_shutdown"`
+	// Fields returned by the REST API that Tunnel doesn't have, indexed by
+	// JSON name. It's best-effort: a field moves out of Extra when it's
+	// added to Tunnel.
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
+
+	// A channel used to communicate the state of the tunnel back to the main
+	// goroutine.
+	ServerStatus chan string       `json:"-"`
+	ClientStatus chan ClientStatus `json:"-"`
+}
+
+//
+// Return the fields of `req` that the tunnel doesn't have, indexed by their
+// JSON name, with the value the REST API applied: for example "ssh_port" if
+// the port requested wasn't honored. Only the fields set in `req` are
+// compared, domain lists are compared regardless of their order. Fields the
+// REST API didn't return aren't compared.
+//
+func (t *Tunnel) DiffFromRequest(req *Request) map[string]interface{} {
+	var diff = make(map[string]interface{})
+
+	if req.TunnelIdentifier != "" &&
+		req.TunnelIdentifier != t.TunnelIdentifier {
+		diff["tunnel_identifier"] = t.TunnelIdentifier
+	}
+	if len(req.DomainNames) > 0 &&
+		!sameDomains(req.DomainNames, t.DomainNames) {
+		diff["domain_names"] = t.DomainNames
+	}
+	if req.KGPPort != 0 && req.KGPPort != t.KGPPort {
+		diff["ssh_port"] = t.KGPPort
+	}
+	if req.UseKGP != nil && *req.UseKGP != t.UseKGP {
+		diff["use_kgp"] = t.UseKGP
+	}
+	if len(req.Labels) > 0 && !reflect.DeepEqual(req.Labels, t.Labels) {
+		diff["labels"] = t.Labels
+	}
+
+	// Fields only available in Extra
+	var extra = func(name string, requested, applied interface{}) {
+		var raw, ok = t.Extra[name]
+		if !ok || json.Unmarshal(raw, applied) != nil {
+			return
+		}
+		var value = reflect.ValueOf(applied).Elem().Interface()
+		if !reflect.DeepEqual(requested, value) {
+			diff[name] = value
+		}
+	}
+	if len(req.DirectDomains) > 0 {
+		extra("direct_domains", req.DirectDomains, new([]string))
+	}
+	if len(req.NoSSLBumpDomains) > 0 {
+		extra("no_ssl_bump_domains", req.NoSSLBumpDomains, new([]string))
+	}
+	if len(req.FastFailRegexps) > 0 {
+		extra("fast_fail_regexps", req.FastFailRegexps, new([]string))
+	}
+	if req.NoProxyCaching {
+		extra("no_proxy_caching", true, new(bool))
+	}
+	if req.SharedTunnel {
+		extra("shared_tunnel", true, new(bool))
+	}
+	if req.VMVersion != "" {
+		extra("vm_version", req.VMVersion, new(string))
+	}
+
+	return diff
+}
+
+func sameDomains(a, b []string) bool {
+	return identityKey("", a) == identityKey("", b)
+}
+
+//
+// Return the domains served by the tunnel, as reported by the REST API. They
+// may differ from the ones of the creation request since the server
+// normalizes them.
+//
+func (t *Tunnel) ServedDomains() []string {
+	return append([]string(nil), t.DomainNames...)
+}
+
+//
+// Return a fingerprint of the identity of a tunnel: the SHA-256 digest of its
+// identifier, its domains, ignoring their order, case, and duplicates,
+// whether it's shared, and whether it uses KGP. Tunnel.Fingerprint and
+// Request.Fingerprint use the same fields, so a tunnel has the fingerprint of
+// the request that created it. Other fields like labels or metadata don't
+// contribute: they don't change which traffic the tunnel serves.
+//
+func fingerprint(identifier string, domains []string, shared, kgp bool) string {
+	var lower = make([]string, 0, len(domains))
+	var seen = make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if !seen[domain] {
+			seen[domain] = true
+			lower = append(lower, domain)
+		}
 	}
-	err := c.executeRequest("DELETE", url, nil, &response)
-	jobsRunning := response.JobsRunning
 
-	return jobsRunning, err
+	var digest = sha256.Sum256([]byte(fmt.Sprintf(
+		"%s\x00shared=%t\x00kgp=%t",
+		identityKey(identifier, lower), shared, kgp)))
+	return hex.EncodeToString(digest[:])
 }
 
-type Metadata struct {
-	Release     string `json:"release"`
-	GitVersion  string `json:"git_version"`
-	Build       string `json:"build"`
-	Platform    string `json:"platform"`
-	Hostname    string `json:"hostname"`
-	NoFileLimit uint64 `json:"nofile_limit"`
-	Command     string `json:"command"`
-}
+//
+// Return the fingerprint of the tunnel, see Request.Fingerprint
+//
+func (t *Tunnel) Fingerprint() string {
+	var shared bool
+	json.Unmarshal(t.Extra["shared_tunnel"], &shared)
 
-type jsonRequest struct {
-	TunnelIdentifier *string   `json:"tunnel_identifier"`
-	DomainNames      []string  `json:"domain_names"`
-	Metadata         Metadata  `json:"metadata"`
-	SSHPort          int       `json:"ssh_port"`
-	NoProxyCaching   bool      `json:"no_proxy_caching"`
-	UseKGP           bool      `json:"use_kgp"`
-	FastFailRegexps  *[]string `json:"fast_fail_regexps"`
-	DirectDomains    *[]string `json:"direct_domains"`
-	SharedTunnel     bool      `json:"shared_tunnel"`
-	SquidConfig      *string   `json:"squid_config"`
-	VMVersion        *string   `json:"vm_version"`
-	NoSSLBumpDomains *[]string `json:"no_ssl_bump_domains"`
-	ExtraInfo        *string   `json:"extra_info"`
+	return fingerprint(t.TunnelIdentifier, t.DomainNames, shared, t.UseKGP)
 }
 
 //
-// Request for a new tunnel
+// Return the URL of the proxy the Sauce Connect client connects to for the
+// tunnel, as "http://host:port", for example
+// "http://maki81134.miso.saucelabs.com:443": it can be passed to url.Parse
+// and http.ProxyURL as-is. Fail if the tunnel isn't running or has no host
+// yet.
 //
-type Request struct {
-	TunnelIdentifier string
-	DomainNames      []string
-
-	DirectDomains    []string
-	KGPPort          int
-	NoProxyCaching   bool
-	FastFailRegexps  []string
-	SharedTunnel     bool
-	VMVersion        string
-	NoSSLBumpDomains []string
+func (t *Tunnel) ProxyURL() (string, error) {
+	if t.State != "running" {
+		return "", fmt.Errorf("Tunnel %s isn't running: %s", t.Id, t.State)
+	}
+	if t.Host == "" || t.KGPPort == 0 {
+		return "", fmt.Errorf("Tunnel %s has no host", t.Id)
+	}
 
-	// Metadata
-	Metadata Metadata
+	var proxy = url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(t.Host, strconv.Itoa(t.KGPPort)),
+	}
+	return proxy.String(), nil
+}
 
-	// Extra info. This is a string (which contains a JSON dict) to enable
-	// optional features and flags.
-	ExtraInfo string
+//
+// Return why the tunnel went away: "user" if a user shut it down, "system" if
+// Sauce Labs did, for example after a failure or when it was idle. Return
+// "running" if the tunnel is still up, and "unknown" if it's down without a
+// reason.
+//
+func (t *Tunnel) ShutdownReason() string {
+	switch {
+	case t.UserShutdown != nil && *t.UserShutdown:
+		return "user"
+	case !isTerminal(t.State):
+		return "running"
+	case t.UserShutdown != nil:
+		return "system"
+	default:
+		return "unknown"
+	}
 }
 
-// Create a new tunnel and wait for it to come up
 //
-// This will start a goroutine to keep track of the tunnel's status using the
-// ClientStatus & ServerStatus channels
-func (c *Client) Create(request *Request) (tunnel Tunnel, err error) {
-	tunnel, err = c.CreateWithTimeout(request, time.Minute)
+// Return how long ago the tunnel was created, 0 if the creation time is
+// unknown. See Client.UseServerTime about clock skew.
+//
+func (t *Tunnel) Age() time.Duration {
+	return t.Client.since(t.CreationTime)
+}
 
-	if err == nil {
-		go tunnel.serverStatusLoop(5 * time.Second)
-		go tunnel.heartbeatLoop(30 * time.Second)
+//
+// Return how long ago a client last connected to the tunnel, or since it was
+// launched if no client connected yet. It's 0 if both are unknown. See
+// Client.UseServerTime about clock skew.
+//
+func (t *Tunnel) IdleDuration() time.Duration {
+	var lastUsed = t.LastConnected
+	if lastUsed.IsZero() {
+		lastUsed = t.LaunchTime
 	}
-	return
+	return t.Client.since(lastUsed)
 }
 
 //
-// Create a new tunnel and wait for it to come up within `wait`.
+// Return a one-line summary of the tunnel for logs, also printed by the %v and
+// %s verbs. Use %+v or %#v to print all its fields.
 //
-func (c *Client) CreateWithTimeout(
-	request *Request,
-	timeout time.Duration,
-) (
-	tunnel Tunnel, err error,
-) {
-	var r = request
+func (t *Tunnel) String() string {
+	var b strings.Builder
 
-	var doc = jsonRequest{
-		TunnelIdentifier: &r.TunnelIdentifier,
-		DomainNames:      r.DomainNames,
-		Metadata:         r.Metadata,
-		SSHPort:          r.KGPPort,
-		NoProxyCaching:   r.NoProxyCaching,
-		UseKGP:           true,
-		FastFailRegexps:  &r.FastFailRegexps,
-		DirectDomains:    &r.DirectDomains,
-		SharedTunnel:     r.SharedTunnel,
-		SquidConfig:      nil,
-		VMVersion:        &r.VMVersion,
-		NoSSLBumpDomains: &r.NoSSLBumpDomains,
-		ExtraInfo:        &r.ExtraInfo,
+	fmt.Fprintf(&b, "tunnel %s", t.Id)
+	if t.TunnelIdentifier != "" {
+		fmt.Fprintf(&b, " (%s)", t.TunnelIdentifier)
 	}
-	var response struct {
-		Id   string `json:"id"`
-		Host string `json:"host"`
+	if t.State != "" {
+		fmt.Fprintf(&b, " %s", t.State)
 	}
-	var url = fmt.Sprintf("%s/%s/tunnels", c.BaseURL, c.Username)
-
-	err = c.executeRequest("POST", url, doc, &response)
-	if err != nil {
-		return
+	if t.Owner != "" {
+		fmt.Fprintf(&b, " owner=%s", t.Owner)
 	}
-
-	tunnel.Client = c
-	tunnel.Id = response.Id
-	tunnel.Host, err = tunnel.wait(timeout)
-	// Only create channels if the tunnel succesfully come up
-	if err == nil {
-		tunnel.ServerStatus = make(chan string)
-		tunnel.ClientStatus = make(chan ClientStatus)
+	fmt.Fprintf(&b, " domains=%s", strings.Join(t.DomainNames, ","))
+	if !t.CreationTime.IsZero() {
+		fmt.Fprintf(&b, " age=%s", t.Age().Round(time.Second))
 	}
-	return
+
+	return b.String()
 }
 
-type ClientStatus struct {
-	Connected        bool
-	LastStatusChange int64
+// Tunnel without its methods, to print its fields
+type plainTunnel Tunnel
+
+//
+// Implement fmt.Formatter for Tunnel values and pointers alike: %v and %s
+// print String, the other verbs print the fields like for any struct.
+//
+func (t Tunnel) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 's', verb == 'v' && !f.Flag('+') && !f.Flag('#'):
+		io.WriteString(f, t.String())
+	case verb == 'v' && f.Flag('#'):
+		var fields = fmt.Sprintf("%#v", plainTunnel(t))
+		io.WriteString(f,
+			"rest.Tunnel"+strings.TrimPrefix(fields, "rest.plainTunnel"))
+	default:
+		fmt.Fprintf(f, fmt.FormatString(f, verb), plainTunnel(t))
+	}
 }
 
 //
-// Tunnel control interface. Create it by calling Client.Create(), all methods
-// are safe to call across goroutines. Tunnel.Status() is updated every XXX
-// seconds by a goroutine that queries the state of the tunnel.
+// Why a keep-alive loop stopped, see Tunnel.KeepAlive
 //
-// We may want to switch the method Status with a direct access to the active
-// channel instead depending of how the main loop is done.
+type KeepAliveStop int
+
+const (
+	// The caller stopped the loop
+	StoppedByCaller KeepAliveStop = iota
+	// The tunnel went down or doesn't exist anymore
+	StoppedTunnelDown
+	// The client was closed
+	StoppedClientClosed
+)
+
 //
-type Tunnel struct {
-	Client *Client
-	Id     string
-	Host   string
-	// A channel used to communicate the state of the tunnel back to the main
-	// goroutine.
-	ServerStatus chan string
-	ClientStatus chan ClientStatus
+// Keep the tunnel alive in the background by sending a heartbeat every
+// `interval`, reporting its Sauce Connect client as connected, for tunnels
+// whose client isn't managed by Create. The status of the tunnel is checked
+// before each heartbeat, and the loop stops on its own once the tunnel is
+// down. Errors are ignored: the loop tries again at the next tick.
+//
+// Call the returned function to stop the loop. `onStopped`, if not nil, is
+// called once when the loop stops, with the reason.
+//
+func (t *Tunnel) KeepAlive(
+	interval time.Duration,
+	onStopped func(reason KeepAliveStop),
+) (stop func()) {
+	var c = t.Client
+	var clock = c.getClock()
+	var closed = c.getState().ctx.Done()
+	var stopped = make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		var reason = StoppedByCaller
+		defer func() {
+			if onStopped != nil {
+				onStopped(reason)
+			}
+		}()
+
+		var start = clock.Now()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-closed:
+				reason = StoppedClientClosed
+				return
+			case <-clock.After(interval):
+			}
+
+			var tunnel, err = c.GetTunnel(t.Id)
+			switch {
+			case errors.Is(err, ErrNotFound),
+				err == nil && isTerminal(tunnel.State):
+				reason = StoppedTunnelDown
+				return
+			case err == nil:
+				c.Ping(t.Id, true, clock.Now().Sub(start))
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(stopped) })
+	}
 }
 
 func (t *Tunnel) heartbeatLoop(interval time.Duration) {
 	var heartbeatTicker = time.NewTicker(interval)
+	defer heartbeatTicker.Stop()
+	var closed = t.Client.getState().ctx.Done()
 	// Initialize the client status before we start the status loop
 	var connected = false
 	var lastChange = time.Now()
 
 	for {
 		select {
+		case <-closed:
+			return
 		case clientStatus := <-t.ClientStatus:
 			connected = clientStatus.Connected
 			lastChange = time.Unix(clientStatus.LastStatusChange, 0)
@@ -440,7 +3963,17 @@ func (t *Tunnel) heartbeatLoop(interval time.Duration) {
 // Goroutine that checks if the tunnel is still up and running
 //
 func (t *Tunnel) serverStatusLoop(interval time.Duration) {
-	for range time.NewTicker(interval).C {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	var closed = t.Client.getState().ctx.Done()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
 		var status, err = t.Status()
 		if err != nil {
 			// FIXME old sauceconnect ignores error
@@ -448,44 +3981,214 @@ func (t *Tunnel) serverStatusLoop(interval time.Duration) {
 			//
 			// The tunnel is down, send its status back to the main loop.
 			//
-			t.ServerStatus <- status
+			t.Client.emit(t.Id, "down", status, nil)
+			select {
+			case t.ServerStatus <- status:
+			case <-closed:
+			}
 			close(t.ServerStatus)
 			return // We're done exit the loop
 		}
 	}
 }
 
-// FIXME the old sauce connect makes an HTTP query and then sleep for 1
-// second up to 60 times. This means the old Sauce Connect would wait up to: 60
-// seconds + 60 * time the HTTP roundtrip.
 //
-// Wait for the tunnel to run
-func (t *Tunnel) wait(timeout time.Duration) (
+// Wait for the tunnel to come up. The tunnel exists once the creation request
+// returned its id, so losing the connection to the REST API while it boots
+// doesn't fail the creation: we keep polling the id until `timeout`, creating
+// the tunnel again would leave a duplicate behind.
+//
+func (t *Tunnel) wait(timeout time.Duration, opts ...Option) (
 	host string,
 	err error,
 ) {
-	var end = time.Now().Add(timeout)
+	var c = t.Client
+	var clock = c.getClock()
+	var backoff = c.backoff(opts...)
+	var end = clock.Now().Add(timeout)
+	var remaining = timeout
 
-	for {
-		status, err := t.Client.status(t.Id)
-		if err != nil {
+	for attempt := 0; ; attempt++ {
+		running, err := c.WaitForStatus(t.Id, "running", remaining, opts...)
+		if err == nil {
+			return running.Host, nil
+		}
+
+		var connectErr *ConnectError
+		if !errors.As(err, &connectErr) || !clock.Now().Before(end) ||
+			errors.Is(err, context.Canceled) ||
+			errors.Is(err, context.DeadlineExceeded) {
 			return "", err
 		}
 
-		if status.Status == "running" {
-			return status.Host, nil
+		select {
+		case <-c.getState().ctx.Done():
+			return "", ErrClosed
+		case <-clock.After(backoff.NextInterval(attempt)):
+		}
+		remaining = end.Sub(clock.Now())
+	}
+}
+
+//
+// Poll tunnel `id` until its status is `status`, and return its details.
+// Return an error if it didn't reach `status` within `timeout`. The delay
+// between two queries follows the Backoff of the call or the Client, see
+// WithBackoff.
+//
+func (c *Client) WaitForStatus(
+	id, status string,
+	timeout time.Duration,
+	opts ...Option,
+) (
+	tunnel Tunnel, err error,
+) {
+	return c.WaitForAnyStatus(id, []string{status}, nil, timeout, opts...)
+}
+
+//
+// Same as WaitForStatus, but return as soon as the status of tunnel `id` is
+// one of `accept`, and fail right away if it's one of `fail` instead of
+// waiting until `timeout`.
+//
+func (c *Client) WaitForAnyStatus(
+	id string,
+	accept, fail []string,
+	timeout time.Duration,
+	opts ...Option,
+) (
+	tunnel Tunnel, err error,
+) {
+	var clock = c.getClock()
+	var backoff = c.backoff(opts...)
+	var end = clock.Now().Add(timeout)
+
+	var o callOptions
+	for _, option := range opts {
+		option(&o)
+	}
+
+	for attempt := 0; ; attempt++ {
+		tunnel, err = c.GetTunnel(id, opts...)
+		if err != nil {
+			return
+		}
+		if o.onPoll != nil {
+			o.onPoll(tunnel)
+		}
+
+		if o.ready != nil && o.ready(&tunnel) ||
+			o.ready == nil && slices.Contains(accept, tunnel.State) {
+			return
+		}
+		if slices.Contains(fail, tunnel.State) {
+			err = fmt.Errorf(
+				"Tunnel %s is %s, expected %s",
+				id, tunnel.State, strings.Join(accept, " or "))
+			return
 		}
 
-		if time.Now().After(end) {
+		if clock.Now().After(end) {
 			break
-		} else {
-			time.Sleep(time.Second)
 		}
+
+		// FIXME the old sauce connect makes an HTTP query and then sleep for 1
+		// second up to 60 times. This means the old Sauce Connect would wait up
+		// to: 60 seconds + 60 * time the HTTP roundtrip.
+		select {
+		case <-c.getState().ctx.Done():
+			return tunnel, ErrClosed
+		case <-clock.After(backoff.NextInterval(attempt)):
+		}
+	}
+
+	if len(accept) == 1 && accept[0] == "running" {
+		err = waitTimeoutError(fmt.Sprintf(
+			"Tunnel %s didn't come up after %s",
+			id, timeout.String()))
+	} else {
+		err = waitTimeoutError(fmt.Sprintf(
+			"Tunnel %s didn't reach status %s after %s",
+			id, strings.Join(accept, " or "), timeout.String()))
+	}
+	return
+}
+
+//
+// Returned by WaitForAnyStatus when the timeout is over, it matches
+// context.DeadlineExceeded with errors.Is
+//
+type waitTimeoutError string
+
+func (e waitTimeoutError) Error() string {
+	return string(e)
+}
+
+func (e waitTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+//
+// Check that the tunnel serves `target`: send a GET request for `target`
+// through `proxyURL`, the proxy of the Sauce Connect client running the
+// tunnel, with `client` or http.DefaultClient's settings if nil. The error
+// says whether the DNS lookup, the connection, or the request failed: the
+// first two wrap a *ConnectError, the last one an *APIError.
+//
+func (t *Tunnel) ProbeURL(
+	ctx context.Context,
+	proxyURL, target string,
+	client *http.Client,
+) error {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %s: %s", proxyURL, err)
+	}
+
+	var probeClient http.Client
+	if client != nil {
+		probeClient = *client
+	}
+	var transport *http.Transport
+	switch rt := probeClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return fmt.Errorf("can't set the proxy of a transport of type %T", rt)
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	probeClient.Transport = transport
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		var dnsErr *net.DNSError
+		var stage = "connection failed"
+		if errors.As(err, &dnsErr) {
+			stage = "DNS lookup failed"
+		}
+		return fmt.Errorf("Tunnel %s can't serve %s: %s: %w",
+			t.Id, target, stage, &ConnectError{URL: target, Err: err})
+	}
+	defer drainingReadCloser{resp.Body}.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Tunnel %s can't serve %s: request failed: %w",
+			t.Id, target, &APIError{
+				URL:        target,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			})
 	}
 
-	return "", fmt.Errorf(
-		"Tunnel %s didn't come up after %s",
-		t.Id, timeout.String())
+	return nil
 }
 
 func (t *Tunnel) Shutdown() (int, error) {
@@ -502,13 +4205,32 @@ type serverStatus struct {
 	Host         string `json:"host"`
 }
 
-func (c *Client) status(id string) (status serverStatus, err error) {
+func (c *Client) status(id string, opts ...Option) (
+	status serverStatus, err error,
+) {
 	var url = fmt.Sprintf("%s/%s/tunnels/%s", c.BaseURL, c.Username, id)
 
-	err = c.executeRequest("GET", url, nil, &status)
+	err = c.executeRequest("GET", url, nil, &status, opts...)
 	return
 }
 
+//
+// Return the details of tunnel `id`
+//
+func (c *Client) GetTunnel(id string, opts ...Option) (
+	tunnel Tunnel, err error,
+) {
+	var url = fmt.Sprintf("%s/%s/tunnels/%s", c.BaseURL, c.Username, id)
+
+	var state tunnelState
+	err = c.executeRequest("GET", url, nil, &state, opts...)
+	if err != nil {
+		return
+	}
+
+	return state.tunnel(c), nil
+}
+
 //
 // status can have the values:
 // - "running" the tunnel is up and running
@@ -516,10 +4238,10 @@ func (c *Client) status(id string) (status serverStatus, err error) {
 // - "terminated" the tunnel was shutdown
 // - "user shutdown" the tunnel was shutdown by the user from the web interface
 //
-func (c *Client) Status(id string) (
+func (c *Client) Status(id string, opts ...Option) (
 	status string, err error,
 ) {
-	s, err := c.status(id)
+	s, err := c.status(id, opts...)
 	if err != nil {
 		return
 	}
@@ -533,8 +4255,140 @@ func (c *Client) Status(id string) (
 	return
 }
 
-func (c *Client) KgpHost(id string) (string, error) {
-	var s, err = c.status(id)
+//
+// Return true if `status` is the status of a tunnel that's down or going down
+//
+func isTerminal(status string) bool {
+	switch status {
+	case "halting", "terminated", "shutdown", "user shutdown", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// Wait for tunnel `id` to run, then call `probe` every `poll` until it
+// succeeds. `probe` checks the tunnel is actually usable, for example by
+// sending a request through the tunnel, since a running tunnel doesn't
+// guarantee the data path is live yet.
+//
+// Return an error if the tunnel went down, or if `ctx` is done before
+// `probe` succeeded.
+//
+func (c *Client) WaitForDomainReady(
+	ctx context.Context,
+	id string,
+	probe func(ctx context.Context) error,
+	poll time.Duration,
+) error {
+	var clock = c.getClock()
+
+	for {
+		status, err := c.Status(id, WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if status == "running" {
+			break
+		}
+		if isTerminal(status) {
+			return fmt.Errorf("Tunnel %s is down: %s", id, status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Tunnel %s didn't come up: %w", id, ctx.Err())
+		case <-clock.After(poll):
+		}
+	}
+
+	for {
+		var err = probe(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf(
+				"Tunnel %s isn't ready: %w (last probe error: %s)",
+				id, ctx.Err(), err)
+		case <-clock.After(poll):
+		}
+	}
+}
+
+//
+// Wait until the tunnel `id` reports the Sauce Connect build `expectedBuild`
+// in its metadata, polling every `poll` until `ctx` is done.
+//
+func (c *Client) WaitForBuild(
+	ctx context.Context,
+	id string,
+	expectedBuild int,
+	poll time.Duration,
+) error {
+	var clock = c.getClock()
+	var lastBuild = "unknown"
+
+	for {
+		tunnel, err := c.GetTunnel(id, WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if isTerminal(tunnel.State) {
+			return fmt.Errorf("Tunnel %s is down: %s", id, tunnel.State)
+		}
+		if build, err := tunnel.Metadata.BuildNumber(); err == nil {
+			if build == expectedBuild {
+				return nil
+			}
+			lastBuild = tunnel.Metadata.Build
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf(
+				"Tunnel %s didn't reach build %d: %w (last build: %s)",
+				id, expectedBuild, ctx.Err(), lastBuild)
+		case <-clock.After(poll):
+		}
+	}
+}
+
+// A client connected to a tunnel within this window is considered active
+const activeClientWindow = 5 * time.Minute
+
+//
+// Return an estimate of how many clients use tunnel `id`.
+//
+// The REST API doesn't track the clients of a tunnel, it only records the
+// last time a Sauce Connect client connected to it in last_connected. So
+// TunnelClients returns 1 if the tunnel is running and a client connected
+// within the last 5 minutes, 0 otherwise: it can't tell apart several clients
+// sharing the tunnel, and a client that connected once and stayed connected
+// for longer isn't counted. Use it as a hint that a shared tunnel is still in
+// use, not as an exact count.
+//
+func (c *Client) TunnelClients(id string, opts ...Option) (int, error) {
+	var tunnel, err = c.GetTunnel(id, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	if tunnel.State != "running" || tunnel.LastConnected.IsZero() {
+		return 0, nil
+	}
+	if c.since(tunnel.LastConnected) > activeClientWindow {
+		return 0, nil
+	}
+
+	return 1, nil
+}
+
+func (c *Client) KgpHost(id string, opts ...Option) (string, error) {
+	var s, err = c.status(id, opts...)
 	if err != nil {
 		return "", err
 	}
@@ -560,6 +4414,7 @@ func (c *Client) Ping(
 	id string,
 	connected bool,
 	duration time.Duration,
+	opts ...Option,
 ) error {
 	var url = fmt.Sprintf("%s/%s/tunnels/%s/connected", c.BaseURL, c.Username, id)
 
@@ -575,5 +4430,5 @@ func (c *Client) Ping(
 	// We don't decode it since it doesn't give us any useful information to
 	// return. It looks like result is always true looking at the REST backend
 	// code.
-	return c.executeRequest("POST", url, &h, nil)
+	return c.executeRequest("POST", url, &h, nil, opts...)
 }
@@ -1,12 +1,23 @@
 package rest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -66,18 +77,47 @@ func stringResponse(s string) R {
 	}
 }
 
+func jsonResponse(s string) R {
+	return func(r http.ResponseWriter, q *http.Request) {
+		r.Header().Set("Content-Type", "application/json")
+		io.WriteString(r, s)
+	}
+}
+
 func errorResponse(code int, s string) R {
 	return func(r http.ResponseWriter, _ *http.Request) {
 		http.Error(r, s, code)
 	}
 }
 
+// Fake clock: time only advances when something waits on it, so waits return
+// immediately.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+
+	var ch = make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
 // Return each response one after another, keeps repeating the last response
 // once it has reached the end.
 func multiResponseServer(responses []R) *httptest.Server {
 	var index = 0
+	var mutex sync.Mutex
 	return httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
 			if index < len(responses) {
 				responses[index](w, r)
 				index += 1
@@ -85,6 +125,28 @@ func multiResponseServer(responses []R) *httptest.Server {
 		}))
 }
 
+func TestClientEndpoints(t *testing.T) {
+	var client = Client{
+		BaseURL:  "https://eu-central-1.saucelabs.com/rest/v1",
+		Username: "john",
+	}
+
+	var endpoints = client.Endpoints()
+	var expected = map[string]string{
+		"list":           "https://eu-central-1.saucelabs.com/rest/v1/john/tunnels?full=1",
+		"create":         "https://eu-central-1.saucelabs.com/rest/v1/john/tunnels",
+		"get":            "https://eu-central-1.saucelabs.com/rest/v1/john/tunnels/{id}",
+		"shutdown":       "https://eu-central-1.saucelabs.com/rest/v1/john/tunnels/{id}",
+		"heartbeat":      "https://eu-central-1.saucelabs.com/rest/v1/john/tunnels/{id}/connected",
+		"service status": "https://eu-central-1.saucelabs.com/rest/v1/info/status",
+		"errors":         "https://eu-central-1.saucelabs.com/rest/v1/john/errors",
+		"versions":       "https://eu-central-1.saucelabs.com/versions.json",
+	}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Invalid endpoints: %+v", endpoints)
+	}
+}
+
 func TestGetLastVersion(t *testing.T) {
 	var server = multiResponseServer([]R{
 		// Just return a fake version.json
@@ -108,6 +170,120 @@ func TestGetLastVersion(t *testing.T) {
 	}
 }
 
+func TestGetLastVersionForPlatform(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(
+		strings.Replace(versionJson, `"build": 42,
+            "download_url": "https://saucelabs.com/downloads/sc-new",
+            "sha1": "123456"
+        },
+        "version"`, `"build": 43,
+            "download_url": "https://saucelabs.com/downloads/sc-osx",
+            "sha1": "123456"
+        },
+        "version"`, 1))))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL: server.URL,
+	}
+
+	build, url, err := client.GetLastVersionForPlatform("osx")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if build != 43 || url != "https://saucelabs.com/downloads/sc-osx" {
+		t.Errorf("Bad build: %d %s", build, url)
+	}
+
+	_, _, err = client.GetLastVersionForPlatform("linux-arm64")
+	var notAvailable *PlatformNotAvailableError
+	if !errors.Is(err, ErrPlatformNotAvailable) ||
+		!errors.As(err, &notAvailable) ||
+		!reflect.DeepEqual(notAvailable.Available,
+			[]string{"linux", "linux32", "osx", "win32"}) ||
+		err.Error() != "No Sauce Connect build for platform linux-arm64 "+
+			"(available: linux, linux32, osx, win32)" {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestPlatformName(t *testing.T) {
+	var expected = map[[2]string]string{
+		{"windows", "amd64"}: "win32",
+		{"linux", "386"}:     "linux32",
+		{"linux", "amd64"}:   "linux",
+		{"darwin", "arm64"}:  "osx",
+		{"linux", "arm64"}:   "",
+		{"plan9", "386"}:     "",
+	}
+
+	for host, name := range expected {
+		platform, err := platformName(host[0], host[1])
+		if platform != name || (err == nil) != (name != "") {
+			t.Errorf("Invalid platform for %v: %q %v", host, platform, err)
+		}
+	}
+}
+
+func TestGetLastVersionCache(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			io.WriteString(w, versionJson)
+		}))
+	defer server.Close()
+
+	var clock = &fakeClock{}
+	var cache = &VersionCache{TTL: time.Minute}
+	var client = Client{
+		BaseURL:      server.URL,
+		VersionCache: cache,
+		clock:        clock,
+	}
+
+	var check = func(expected int) {
+		build, _, err := client.GetLastVersionForPlatform("linux")
+		if err != nil || build != 42 {
+			t.Errorf("GetLastVersion failed: %v %v", build, err)
+		}
+		if requests != expected {
+			t.Errorf("Invalid number of requests: %d != %d",
+				requests, expected)
+		}
+	}
+
+	check(1)
+	check(1)
+	clock.After(time.Minute)
+	check(2)
+	check(2)
+	cache.ForceRefresh()
+	check(3)
+}
+
+func TestGetAvailablePlatforms(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(strings.Replace(versionJson, `"version": "4.3.16",`,
+			`"version": "4.3.16", "linux-arm64": {"build": 43},`, 1)),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL: server.URL,
+	}
+
+	platforms, err := client.GetAvailablePlatforms()
+	if err != nil {
+		t.Errorf("client.GetAvailablePlatforms errored %+v\n", err)
+	}
+
+	var expected = []string{"linux", "linux-arm64", "linux32", "osx", "win32"}
+	if !reflect.DeepEqual(platforms, expected) {
+		t.Errorf("Invalid platforms: %v", platforms)
+	}
+}
+
 func TestGetLastVersionBadJSON(t *testing.T) {
 	var server = multiResponseServer([]R{
 		stringResponse("Not a JSON document"),
@@ -146,6 +322,10 @@ func TestGetLastVersion404(t *testing.T) {
 	if !strings.HasPrefix(err.Error(), "error querying ") {
 		t.Errorf("Invalid error: %s", err.Error())
 	}
+	var apiErr *APIError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) {
+		t.Errorf("Invalid error type: %#v", err)
+	}
 }
 
 func TestGetLastVersionNoServer(t *testing.T) {
@@ -168,6 +348,255 @@ func TestGetLastVersionNoServer(t *testing.T) {
 	}
 }
 
+func TestDecodeJSONLargeNumbers(t *testing.T) {
+	var v interface{}
+	var err = decodeJSON(
+		io.NopCloser(strings.NewReader(`{"id": 9007199254740993}`)), &v)
+	if err != nil {
+		t.Fatalf("decodeJSON errored %+v\n", err)
+	}
+
+	var id = v.(map[string]interface{})["id"]
+	if id != json.Number("9007199254740993") {
+		t.Errorf("Invalid number: %#v", id)
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	var server = multiResponseServer([]R{})
+	server.Close()
+
+	var client = Client{
+		BaseURL: server.URL,
+	}
+	_, _, err := client.GetLastVersion()
+
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	if connectErr.URL != server.URL+"/versions.json" {
+		t.Errorf("Invalid URL: %s", connectErr.URL)
+	}
+	if connectErr.Timeout() {
+		t.Errorf("Refused connection reported as a timeout")
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Errorf("Invalid wrapped error: %v", connectErr.Err)
+	}
+}
+
+func TestConnectErrorTimeout(t *testing.T) {
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL: server.URL,
+		Client:  http.Client{Timeout: 10 * time.Millisecond},
+	}
+	_, _, err := client.GetLastVersion()
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestRetryTransientDecodeError(t *testing.T) {
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html>502 Bad Gateway</html>")
+		},
+		errorResponse(502, "Bad Gateway"),
+		jsonResponse(versionJson),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	}
+	build, _, err := client.GetLastVersion()
+
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if build != 42 {
+		t.Errorf("Bad build number: %d", build)
+	}
+}
+
+func TestRetrySchemaDecodeError(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			jsonResponse(`{"Sauce Connect": {"linux": {"build": "42"}}}`)(w, r)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	}
+	_, _, err := client.GetLastVersion()
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Transient {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Schema error was retried: %d requests", requests)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST":
+				io.WriteString(w, `{"result": true, "id": "fakeid"}`)
+			case "DELETE":
+				http.Error(w, "nothing to see here", 404)
+			default:
+				// Trailing data after the JSON document
+				io.WriteString(w, createJSON+"\n\n")
+			}
+		}))
+	defer server.Close()
+
+	var dials = 0
+	var dialer net.Dialer
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(
+					ctx context.Context, network, addr string,
+				) (net.Conn, error) {
+					dials += 1
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.Ping("fakeid", true, time.Second); err != nil {
+			t.Errorf("client.Ping errored %+v\n", err)
+		}
+		if _, err := client.GetTunnel("fakeid"); err != nil {
+			t.Errorf("client.GetTunnel errored %+v\n", err)
+		}
+		if _, err := client.Shutdown("fakeid"); err == nil {
+			t.Errorf("client.Shutdown didn't error")
+		}
+	}
+
+	if dials != 1 {
+		t.Errorf("Connection wasn't reused: %d connections", dials)
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	const tunnelsJSON = `[{"id": "fakeid", "status": "running"}]`
+
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				t.Errorf("Client doesn't accept gzip: %v", r.Header)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			var writer = gzip.NewWriter(w)
+			io.WriteString(writer, tunnelsJSON)
+			writer.Close()
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	tunnels, err := client.ListTunnels()
+	if err != nil {
+		t.Errorf("client.ListTunnels errored %+v\n", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Id != "fakeid" {
+		t.Errorf("Invalid tunnels: %+v", tunnels)
+	}
+}
+
+func TestRetryPredicate(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			if requests < 3 {
+				http.Error(w, "Slow down", 429)
+			} else {
+				io.WriteString(w, versionJson)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		MaxRetries: 5,
+		RetryDelay: time.Millisecond,
+		RetryPredicate: func(resp *http.Response, err error) bool {
+			return resp != nil && resp.StatusCode == 429
+		},
+	}
+
+	build, _, err := client.GetLastVersion()
+	if err != nil || build != 42 {
+		t.Errorf("GetLastVersion failed: %v %v", build, err)
+	}
+	if requests != 3 {
+		t.Errorf("Invalid number of requests: %d", requests)
+	}
+}
+
+func TestRetryPredicateMaxRetries(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			http.Error(w, "Nothing to see here", 404)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		MaxRetries: 3,
+		RetryDelay: time.Millisecond,
+		RetryPredicate: func(resp *http.Response, err error) bool {
+			return true
+		},
+	}
+
+	_, _, err := client.GetLastVersion()
+	if err == nil {
+		t.Errorf("GetLastVersion didn't error")
+	}
+	if requests != 4 {
+		t.Errorf("Invalid number of requests: %d", requests)
+	}
+}
+
 func TestClientFind(t *testing.T) {
 	const tunnelsJSON = `[
       {
@@ -353,9 +782,17 @@ func TestFindBugScClient(t *testing.T) {
 	}
 }
 
-func TestClientShutdown(t *testing.T) {
+func TestClientFindTunnels(t *testing.T) {
+	const tunnelsJSON = `[{
+		"status": "running",
+		"tunnel_identifier": "sauce",
+		"host": "maki81134.miso.saucelabs.com",
+		"ssh_port": 443,
+		"id": "fakeid",
+		"domain_names": ["sauce-connect.proxy"]}]`
+
 	var server = multiResponseServer([]R{
-		stringResponse("{ \"jobs_running\": 0 }"),
+		stringResponse(tunnelsJSON),
 	})
 	defer server.Close()
 
@@ -365,17 +802,35 @@ func TestClientShutdown(t *testing.T) {
 		Password: "password",
 	}
 
-	_, err := client.Shutdown("fakeid")
+	var matches, err = client.FindTunnels("sauce", []string{})
+
 	if err != nil {
-		t.Errorf("client.Shutdown errored %+v\n", err)
+		t.Errorf("client.FindTunnels errored: %s", err)
+	}
+
+	if len(matches) != 1 {
+		t.Fatalf("client.FindTunnels returned %+v\n", matches)
+	}
+
+	var tunnel = matches[0]
+	if tunnel.Id != "fakeid" ||
+		tunnel.Host != "maki81134.miso.saucelabs.com" ||
+		tunnel.State != "running" ||
+		tunnel.KGPPort != 443 ||
+		tunnel.TunnelIdentifier != "sauce" ||
+		!reflect.DeepEqual(tunnel.DomainNames, []string{"sauce-connect.proxy"}) {
+		t.Errorf("Invalid tunnel: %+v\n", tunnel)
+	}
+	if tunnel.Client != &client {
+		t.Errorf("Tunnel isn't bound to the client")
 	}
 }
 
-func TestClientShutdownRunning(t *testing.T) {
-	var jobsRunning = 0
+func TestClientGetTunnel(t *testing.T) {
 	var server = multiResponseServer([]R{
-		stringResponse(fmt.Sprintf("{ \"jobs_running\": %d }", jobsRunning)),
+		stringResponse(createJSON),
 	})
+	defer server.Close()
 
 	var client = Client{
 		BaseURL:  server.URL,
@@ -383,20 +838,20 @@ func TestClientShutdownRunning(t *testing.T) {
 		Password: "password",
 	}
 
-	jobs, err := client.Shutdown("fakeid")
+	tunnel, err := client.GetTunnel("49958ce5ec9f49c796542e0c691455a6")
 	if err != nil {
-		t.Errorf("client.Shutdown errored %+v\n", err)
+		t.Errorf("client.GetTunnel errored %+v\n", err)
 	}
-	if jobs != jobsRunning {
-		t.Errorf("client.Shutdown did not return proper jobs_runnng value, was %d expected %d",
-			jobsRunning,
-			jobs)
+	if tunnel.Id != "49958ce5ec9f49c796542e0c691455a6" ||
+		tunnel.State != "new" ||
+		tunnel.KGPPort != 443 {
+		t.Errorf("Invalid tunnel: %+v\n", tunnel)
 	}
 }
 
-func TestClientShutdown404(t *testing.T) {
+func TestClientGetTunnelExtra(t *testing.T) {
 	var server = multiResponseServer([]R{
-		errorResponse(404, "nothing to see here"),
+		stringResponse(createJSON),
 	})
 	defer server.Close()
 
@@ -406,38 +861,1375 @@ func TestClientShutdown404(t *testing.T) {
 		Password: "password",
 	}
 
-	_, err := client.Shutdown("fakeid")
-	if !strings.HasPrefix(err.Error(), "error querying ") {
-		t.Errorf("Invalid error: %s", err.Error())
+	tunnel, err := client.GetTunnel("49958ce5ec9f49c796542e0c691455a6")
+	if err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+	if string(tunnel.Extra["shared_tunnel"]) != "false" ||
+		string(tunnel.Extra["vm_version"]) != "null" {
+		t.Errorf("Invalid extra fields: %s\n", tunnel.Extra)
+	}
+	if _, ok := tunnel.Extra["id"]; ok {
+		t.Errorf("Known field in extra fields: %s\n", tunnel.Extra)
 	}
 }
 
-const createJSON = `{
-  "status": "new",
-  "direct_domains": null,
-  "vm_version": null,
-  "last_connected": null,
-  "shutdown_time": null,
-  "ssh_port": 443,
-  "launch_time": null,
-  "user_shutdown": null,
-  "use_caching_proxy": null,
-  "creation_time": 1467839998,
-  "domain_names": [
-    "sauce-connect.proxy"
-  ],
-  "shared_tunnel": false,
-  "tunnel_identifier": null,
-  "host": null,
-  "no_proxy_caching": false,
-  "owner": "henryprecheur",
-  "use_kgp": true,
-  "no_ssl_bump_domains": null,
-  "id": "49958ce5ec9f49c796542e0c691455a6",
-  "metadata": {
-    "hostname": "Henry's computer",
-    "git_version": "4a804fd",
-    "platform": "plan9",
+func TestTunnelDiffFromRequest(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	tunnel, err := client.GetTunnel("49958ce5ec9f49c796542e0c691455a6")
+	if err != nil {
+		t.Fatalf("client.GetTunnel errored %+v\n", err)
+	}
+
+	var request = Request{
+		DomainNames:  []string{"sauce-connect.proxy"},
+		KGPPort:      8443,
+		SharedTunnel: true,
+	}
+	var expected = map[string]interface{}{
+		"ssh_port":      443,
+		"shared_tunnel": false,
+	}
+	var diff = tunnel.DiffFromRequest(&request)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Invalid diff: %v", diff)
+	}
+
+	// Neither the identifier nor the domains were requested
+	diff = tunnel.DiffFromRequest(&Request{})
+	if len(diff) != 0 {
+		t.Errorf("Invalid diff: %v", diff)
+	}
+}
+
+func TestTunnelProxyURL(t *testing.T) {
+	var tunnel = Tunnel{
+		Id:      "fakeid",
+		Host:    "maki81134.miso.saucelabs.com",
+		State:   "running",
+		KGPPort: 443,
+	}
+
+	proxyURL, err := tunnel.ProxyURL()
+	if err != nil || proxyURL != "http://maki81134.miso.saucelabs.com:443" {
+		t.Errorf("Invalid proxy URL: %s %v", proxyURL, err)
+	}
+	if u, err := url.Parse(proxyURL); err != nil ||
+		u.Hostname() != "maki81134.miso.saucelabs.com" || u.Port() != "443" {
+		t.Errorf("Invalid parsed proxy URL: %+v %v", u, err)
+	}
+
+	tunnel.State = "booting"
+	_, err = tunnel.ProxyURL()
+	if err == nil || err.Error() != "Tunnel fakeid isn't running: booting" {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	tunnel.State = "running"
+	tunnel.Host = ""
+	if _, err = tunnel.ProxyURL(); err == nil {
+		t.Errorf("tunnel.ProxyURL didn't error")
+	}
+}
+
+func TestTunnelShutdownReason(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "running", "user_shutdown": null}`),
+		stringResponse(`{"status": "terminated", "user_shutdown": true}`),
+		stringResponse(`{"status": "terminated", "user_shutdown": false}`),
+		stringResponse(`{"status": "terminated", "user_shutdown": null}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	for _, expected := range []string{"running", "user", "system", "unknown"} {
+		tunnel, err := client.GetTunnel("fakeid")
+		if err != nil {
+			t.Errorf("client.GetTunnel errored %+v\n", err)
+		}
+		if reason := tunnel.ShutdownReason(); reason != expected {
+			t.Errorf("Invalid shutdown reason: %s != %s", reason, expected)
+		}
+	}
+}
+
+func TestClientTunnelClients(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "running", "last_connected": 1467691618}`),
+		stringResponse(`{"status": "running", "last_connected": 1467690000}`),
+		stringResponse(`{"status": "running", "last_connected": null}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{now: time.Unix(1467691678, 0)},
+	}
+
+	for _, expected := range []int{1, 0, 0} {
+		clients, err := client.TunnelClients("fakeid")
+		if err != nil {
+			t.Errorf("client.TunnelClients errored %+v\n", err)
+		}
+		if clients != expected {
+			t.Errorf("Invalid number of clients: %d != %d", clients, expected)
+		}
+	}
+}
+
+func TestClientGetTunnelTimeout(t *testing.T) {
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(w, createJSON)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	_, err := client.GetTunnel("fakeid", WithTimeout(10*time.Millisecond))
+	if err == nil {
+		t.Fatalf("client.GetTunnel didn't time out")
+	}
+	if !strings.HasPrefix(err.Error(), "couldn't connect to ") {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+	if client.Client.Timeout != 0 {
+		t.Errorf("WithTimeout mutated the client")
+	}
+}
+
+func TestClientConcurrencyLimits(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running"},
+		{"id": "b", "status": "booting"},
+		{"id": "c", "status": "terminated"},
+		{"id": "d", "status": "error"},
+		{"id": "e", "status": "user shutdown"}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		Username:   "username",
+		Password:   "password",
+		MaxTunnels: 5,
+	}
+
+	limits, err := client.ConcurrencyLimits()
+	if err != nil {
+		t.Errorf("client.ConcurrencyLimits errored %+v\n", err)
+	}
+	if limits != (Limits{MaxTunnels: 5, ActiveTunnels: 2}) {
+		t.Errorf("Invalid limits: %+v\n", limits)
+	}
+}
+
+func TestClientCanProvision(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "a", "status": "running"},
+			{"id": "b", "status": "booting"}]`),
+		stringResponse(`[{"id": "a", "status": "running"}]`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:    server.URL,
+		Username:   "username",
+		Password:   "password",
+		MaxTunnels: 4,
+	}
+
+	ok, available, err := client.CanProvision(3)
+	if err != nil || ok || available != 2 {
+		t.Errorf("Invalid result: %v %d %v\n", ok, available, err)
+	}
+	ok, available, err = client.CanProvision(3)
+	if err != nil || !ok || available != 3 {
+		t.Errorf("Invalid result: %v %d %v\n", ok, available, err)
+	}
+
+	client.MaxTunnels = 0
+	if _, _, err = client.CanProvision(1); err == nil {
+		t.Errorf("client.CanProvision didn't fail without MaxTunnels")
+	}
+}
+
+func TestClientListSorted(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "owner": "carol",
+		 "creation_time": 2000, "last_connected": 3000},
+		{"id": "b", "status": "booting", "owner": "alice",
+		 "creation_time": 1000, "last_connected": null},
+		{"id": "c", "status": "running", "owner": "bob",
+		 "creation_time": 3000, "last_connected": 4000}]`
+
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tunnelsJSON)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var tests = []struct {
+		by       SortField
+		desc     bool
+		expected []string
+	}{
+		{ByCreationTime, false, []string{"b", "a", "c"}},
+		{ByCreationTime, true, []string{"c", "a", "b"}},
+		{ByLastConnected, false, []string{"b", "a", "c"}},
+		{ByLastConnected, true, []string{"c", "a", "b"}},
+		{ByStatus, false, []string{"b", "a", "c"}},
+		{ByStatus, true, []string{"c", "a", "b"}},
+		{ByOwner, false, []string{"b", "c", "a"}},
+		{ByOwner, true, []string{"a", "c", "b"}},
+	}
+
+	for _, test := range tests {
+		tunnels, err := client.ListSorted(test.by, test.desc)
+		if err != nil {
+			t.Errorf("client.ListSorted errored %+v\n", err)
+		}
+		if ids := tunnelIds(tunnels); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("ListSorted(%d, %v) = %q, expected %q",
+				test.by, test.desc, ids, test.expected)
+		}
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	var queries []string
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			queries = append(queries, r.URL.RawQuery)
+			if r.URL.Query().Get("full") == "" {
+				io.WriteString(w, `["a", "b"]`)
+				return
+			}
+			// The server ignores the status filter
+			io.WriteString(w, `[
+				{"id": "a", "status": "running",
+				 "metadata": {"platform": "Linux"}},
+				{"id": "b", "status": "running",
+				 "metadata": {"platform": "Windows"}},
+				{"id": "c", "status": "terminated",
+				 "metadata": {"platform": "Linux"}}]`)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	tunnels, err := client.Query(QueryOptions{
+		Status: "running",
+		Full:   true,
+		Predicate: func(tunnel Tunnel) bool {
+			return tunnel.Metadata.Platform == "Linux"
+		},
+	})
+	if err != nil {
+		t.Errorf("client.Query errored %+v\n", err)
+	}
+	if !reflect.DeepEqual(tunnelIds(tunnels), []string{"a"}) {
+		t.Errorf("Invalid tunnels: %+v", tunnels)
+	}
+
+	if tunnels, err = client.Query(QueryOptions{}); err != nil {
+		t.Errorf("client.Query errored %+v\n", err)
+	}
+	if !reflect.DeepEqual(tunnelIds(tunnels), []string{"a", "b"}) {
+		t.Errorf("Invalid tunnels: %+v", tunnels)
+	}
+
+	// The predicate needs the details even without Full
+	tunnels, err = client.Query(QueryOptions{
+		Predicate: func(tunnel Tunnel) bool {
+			return tunnel.Metadata.Platform == "Windows"
+		},
+	})
+	if err != nil {
+		t.Errorf("client.Query errored %+v\n", err)
+	}
+	if !reflect.DeepEqual(tunnelIds(tunnels), []string{"b"}) {
+		t.Errorf("Invalid tunnels: %+v", tunnels)
+	}
+
+	var expected = []string{"full=1&status=running", "", "full=1"}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("Invalid queries: %q", queries)
+	}
+}
+
+func TestClientFleetSummary(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "creation_time": 1467690000},
+		{"id": "b", "status": "running", "creation_time": 1467693600},
+		{"id": "c", "status": "new", "creation_time": 1467696000},
+		{"id": "d", "status": "booting", "creation_time": 1467696000},
+		{"id": "e", "status": "error", "creation_time": 1467680000},
+		{"id": "f", "status": "terminated", "creation_time": 1467600000}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{now: time.Unix(1467697200, 0)},
+	}
+
+	summary, err := client.FleetSummary()
+	if err != nil {
+		t.Fatalf("client.FleetSummary errored %+v\n", err)
+	}
+
+	var expected = FleetSummary{
+		Total:     6,
+		Running:   2,
+		Booting:   2,
+		Failed:    1,
+		Down:      1,
+		OldestAge: 2 * time.Hour,
+	}
+	if *summary != expected {
+		t.Errorf("Invalid summary: %+v\n", *summary)
+	}
+}
+
+func TestTunnelAgeClockSkew(t *testing.T) {
+	var serverTime = time.Unix(1467690959, 0).Add(10 * time.Minute)
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+			fmt.Fprint(w, `{"id": "fakeid", "status": "running",
+				"creation_time": 1467690959}`)
+		}))
+	defer server.Close()
+
+	// The local clock is an hour behind the server
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{now: serverTime.Add(-time.Hour)},
+	}
+
+	tunnel, err := client.GetTunnel("fakeid")
+	if err != nil {
+		t.Fatalf("client.GetTunnel errored %+v\n", err)
+	}
+	if age := tunnel.Age(); age != 0 {
+		t.Errorf("Invalid age with the local time: %s", age)
+	}
+
+	client.UseServerTime = true
+	if tunnel, err = client.GetTunnel("fakeid"); err != nil {
+		t.Fatalf("client.GetTunnel errored %+v\n", err)
+	}
+	if age := tunnel.Age(); age != 10*time.Minute {
+		t.Errorf("Invalid age with the server time: %s", age)
+	}
+}
+
+func TestClientListWithHealth(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "last_connected": 1467697000},
+		{"id": "b", "status": "running", "last_connected": 1467690000},
+		{"id": "c", "status": "running", "launch_time": 1467690000},
+		{"id": "d", "status": "booting", "creation_time": 1467697000},
+		{"id": "e", "status": "booting", "creation_time": 1467690000},
+		{"id": "f", "status": "error"},
+		{"id": "g", "status": "terminated"}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:     server.URL,
+		Username:    "username",
+		Password:    "password",
+		MaxIdleTime: 30 * time.Minute,
+		clock:       &fakeClock{now: time.Unix(1467697200, 0)},
+	}
+
+	list, err := client.ListWithHealth()
+	if err != nil {
+		t.Fatalf("client.ListWithHealth errored %+v\n", err)
+	}
+
+	var expected = []string{
+		"a: true ",
+		"b: false idle too long",
+		"c: false idle too long",
+		"d: true booting",
+		"e: false failed to boot",
+		"f: false error",
+		"g: false down",
+	}
+	var health []string
+	for _, h := range list {
+		health = append(health,
+			fmt.Sprintf("%s: %t %s", h.Id, h.Healthy, h.Reason))
+	}
+	if !reflect.DeepEqual(health, expected) {
+		t.Errorf("Invalid health: %q", health)
+	}
+}
+
+func TestClientListByLabel(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "metadata": {"labels": {"team": "web"}}},
+		{"id": "b", "metadata": {"labels": {"team": "mobile"}}},
+		{"id": "c", "metadata": {}}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	matches, err := client.ListByLabel("team", "web")
+	if err != nil {
+		t.Errorf("client.ListByLabel errored %+v\n", err)
+	}
+	if len(matches) != 1 || matches[0].Id != "a" ||
+		!reflect.DeepEqual(matches[0].Labels, map[string]string{"team": "web"}) {
+		t.Errorf("client.ListByLabel returned %+v\n", matches)
+	}
+}
+
+func TestClientListByPlatform(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "metadata": {"platform": "Linux 4.6.0-1-amd64 x86_64"}},
+		{"id": "b", "metadata": {"platform": "Windows 10 AMD64"}},
+		{"id": "c", "metadata": {"platform": "Linux 5.10.0 aarch64"}},
+		{"id": "d", "metadata": {}}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	matches, err := client.ListByPlatform("linux")
+	if err != nil {
+		t.Errorf("client.ListByPlatform errored %+v\n", err)
+	}
+	if !reflect.DeepEqual(tunnelIds(matches), []string{"a", "c"}) {
+		t.Errorf("client.ListByPlatform returned %+v\n", matches)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	var request = Request{
+		TunnelIdentifier: "web",
+		DomainNames:      []string{"b.example.com", "A.example.com"},
+		SharedTunnel:     true,
+	}
+
+	var state tunnelState
+	var err = json.Unmarshal([]byte(`{
+		"tunnel_identifier": "web",
+		"domain_names": ["a.example.com", "b.example.com", "b.example.com"],
+		"use_kgp": true,
+		"shared_tunnel": true,
+		"metadata": {"labels": {"team": "web"}}}`), &state)
+	if err != nil {
+		t.Fatalf("json.Unmarshal errored %+v\n", err)
+	}
+	var tunnel = state.tunnel(nil)
+
+	if request.Fingerprint() != tunnel.Fingerprint() {
+		t.Errorf("Fingerprints differ: %s, %s",
+			request.Fingerprint(), tunnel.Fingerprint())
+	}
+
+	request.SharedTunnel = false
+	if request.Fingerprint() == tunnel.Fingerprint() {
+		t.Errorf("Fingerprints match without a shared tunnel")
+	}
+}
+
+func TestClientLabelsRoundTrip(t *testing.T) {
+	var metadata json.RawMessage
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				var doc struct {
+					Metadata json.RawMessage `json:"metadata"`
+				}
+				decodeJSON(r.Body, &doc)
+				metadata = doc.Metadata
+				io.WriteString(w, createJSON)
+				return
+			}
+			fmt.Fprintf(w, `[
+				{"id": "a", "status": "running", "metadata": %s},
+				{"id": "b", "status": "running", "metadata": {}}]`,
+				metadata)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var labels = map[string]string{"cost-center": "1234", "project": "web"}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		Labels:      labels,
+		NoWait:      true,
+	}
+
+	if _, err := client.Create(&request); err != nil {
+		t.Errorf("client.Create errored %+v\n", err)
+	}
+
+	matches, err := client.ListByLabel("cost-center", "1234")
+	if err != nil {
+		t.Errorf("client.ListByLabel errored %+v\n", err)
+	}
+	if len(matches) != 1 || matches[0].Id != "a" ||
+		!reflect.DeepEqual(matches[0].Labels, labels) {
+		t.Errorf("client.ListByLabel returned %+v\n", matches)
+	}
+}
+
+func TestClientFindTunnelForDomain(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "domain_names": ["*.example.com"]},
+		{"id": "b", "status": "running", "domain_names": ["api.example.com"]},
+		{"id": "c", "status": "terminated", "domain_names": ["other.com"]},
+		{"id": "d", "status": "running", "domain_names": ["Sauce.Proxy"]},
+		{"id": "e", "status": "running", "domain_names": ["*foo.com"]}]`
+
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tunnelsJSON)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var tests = []struct {
+		domain string
+		id     string
+		err    error
+	}{
+		{"www.example.com", "a", nil},
+		{"sauce.proxy", "d", nil},
+		{"api.example.com", "", ErrAmbiguousDomain},
+		{"example.com", "", ErrNoMatchingTunnel},
+		{"other.com", "", ErrNoMatchingTunnel},
+		// Only "*." is a wildcard
+		{"barfoo.com", "", ErrNoMatchingTunnel},
+	}
+
+	for _, test := range tests {
+		tunnel, err := client.FindTunnelForDomain(test.domain)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: invalid error %v", test.domain, err)
+			}
+			continue
+		}
+		if err != nil || tunnel.Id != test.id {
+			t.Errorf("%s: invalid tunnel %+v, %v", test.domain, tunnel, err)
+		}
+	}
+}
+
+func TestClientAccountDefaults(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "old", "creation_time": 1000, "shared_tunnel": false},
+			{"id": "new", "creation_time": 2000, "tunnel_identifier": "web",
+			 "domain_names": ["a.example.com"], "use_kgp": true,
+			 "ssh_port": 443, "shared_tunnel": true, "vm_version": "v2",
+			 "direct_domains": ["cdn.example.com"], "no_proxy_caching": true}]`),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+
+	defaults, err := client.AccountDefaults()
+	if err != nil {
+		t.Fatalf("client.AccountDefaults errored %+v\n", err)
+	}
+	if defaults.TunnelIdentifier != "" || len(defaults.DomainNames) != 0 ||
+		!defaults.SharedTunnel || !defaults.NoProxyCaching ||
+		defaults.VMVersion != "v2" || defaults.KGPPort != 443 ||
+		defaults.UseKGP == nil || !*defaults.UseKGP ||
+		!reflect.DeepEqual(defaults.DirectDomains,
+			[]string{"cdn.example.com"}) {
+		t.Errorf("Invalid defaults: %+v", defaults)
+	}
+
+	// Served from the cache, and not affected by the previous caller
+	defaults.DirectDomains[0] = "changed"
+	if defaults, err = client.AccountDefaults(); err != nil {
+		t.Fatalf("client.AccountDefaults errored %+v\n", err)
+	}
+	if defaults.DirectDomains[0] != "cdn.example.com" {
+		t.Errorf("The cached defaults were modified: %+v", defaults)
+	}
+}
+
+func TestClientPickTunnel(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "tunnel_identifier": "sauce",
+		 "creation_time": 100, "last_connected": 500},
+		{"id": "b", "status": "running", "tunnel_identifier": "sauce",
+		 "creation_time": 300, "last_connected": 400},
+		{"id": "c", "status": "running", "tunnel_identifier": "sauce",
+		 "creation_time": 200, "last_connected": null},
+		{"id": "d", "status": "terminated", "tunnel_identifier": "sauce",
+		 "creation_time": 50, "last_connected": 600}]`
+
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(tunnelsJSON)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var expected = map[SelectStrategy]string{
+		Newest:                "b",
+		Oldest:                "a",
+		MostRecentlyConnected: "a",
+	}
+	for strategy, id := range expected {
+		tunnel, err := client.PickTunnel("sauce", nil, strategy)
+		if err != nil {
+			t.Errorf("client.PickTunnel errored %+v\n", err)
+		} else if tunnel.Id != id {
+			t.Errorf("Strategy %d picked %s instead of %s",
+				strategy, tunnel.Id, id)
+		}
+	}
+
+	_, err := client.PickTunnel("other", nil, Newest)
+	if err != ErrNoMatchingTunnel {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientSnapshot(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "b", "status": "running", "tunnel_identifier": "sauce",
+		 "domain_names": ["sauce-connect.proxy"], "creation_time": 300,
+		 "metadata": {"build": "2396", "labels": {"team": "web"}}},
+		{"id": "a", "status": "booting", "creation_time": 100}]`
+
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(tunnelsJSON)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	snapshot, err := client.Snapshot()
+	if err != nil {
+		t.Fatalf("client.Snapshot errored %+v\n", err)
+	}
+
+	again, err := client.Snapshot()
+	if err != nil || string(snapshot) != string(again) {
+		t.Errorf("Snapshots aren't stable: %v", err)
+	}
+
+	tunnels, err := LoadSnapshot(snapshot)
+	if err != nil {
+		t.Fatalf("LoadSnapshot errored %+v\n", err)
+	}
+	if len(tunnels) != 2 || tunnels[0].Id != "a" || tunnels[1].Id != "b" {
+		t.Fatalf("Invalid tunnels: %+v", tunnels)
+	}
+
+	var tunnel = tunnels[1]
+	if tunnel.State != "running" ||
+		tunnel.TunnelIdentifier != "sauce" ||
+		!tunnel.CreationTime.Equal(time.Unix(300, 0)) ||
+		!tunnel.LastConnected.IsZero() ||
+		tunnel.Metadata.Build != "2396" ||
+		tunnel.Labels["team"] != "web" ||
+		tunnel.Client != nil {
+		t.Errorf("Invalid tunnel: %+v", tunnel)
+	}
+}
+
+func tunnelIds(tunnels []Tunnel) (ids []string) {
+	for _, tunnel := range tunnels {
+		ids = append(ids, tunnel.Id)
+	}
+	return
+}
+
+func TestDiffTunnels(t *testing.T) {
+	var desired = []Tunnel{
+		// Unchanged, with different metadata & domain order
+		{
+			TunnelIdentifier: "web",
+			DomainNames:      []string{"b.example.com", "a.example.com"},
+			Metadata:         Metadata{Release: "4.4.0"},
+		},
+		// Missing
+		{TunnelIdentifier: "mobile", DomainNames: []string{"m.example.com"}},
+		// Same identifier as an actual tunnel, but different domains
+		{TunnelIdentifier: "api", DomainNames: []string{"new.example.com"}},
+		// Unnamed tunnel
+		{DomainNames: []string{"sauce-connect.proxy"}},
+	}
+	var actual = []Tunnel{
+		{
+			Id:               "1",
+			State:            "running",
+			TunnelIdentifier: "web",
+			DomainNames:      []string{"a.example.com", "b.example.com"},
+			Metadata:         Metadata{Release: "4.3.16"},
+		},
+		{
+			Id:               "2",
+			State:            "running",
+			TunnelIdentifier: "api",
+			DomainNames:      []string{"old.example.com"},
+		},
+		// Duplicate of "1"
+		{
+			Id:               "3",
+			State:            "booting",
+			TunnelIdentifier: "web",
+			DomainNames:      []string{"b.example.com", "a.example.com"},
+		},
+		{
+			Id:          "4",
+			State:       "running",
+			DomainNames: []string{"sauce-connect.proxy"},
+		},
+		// Already down
+		{Id: "5", State: "terminated", TunnelIdentifier: "stale"},
+	}
+
+	toCreate, toShutdown, unchanged := DiffTunnels(desired, actual)
+
+	if len(toCreate) != 2 ||
+		toCreate[0].TunnelIdentifier != "mobile" ||
+		toCreate[1].TunnelIdentifier != "api" {
+		t.Errorf("Invalid toCreate: %+v", toCreate)
+	}
+	if ids := tunnelIds(toShutdown); !reflect.DeepEqual(ids, []string{"2", "3"}) {
+		t.Errorf("Invalid toShutdown: %v", ids)
+	}
+	if ids := tunnelIds(unchanged); !reflect.DeepEqual(ids, []string{"1", "4"}) {
+		t.Errorf("Invalid unchanged: %v", ids)
+	}
+}
+
+func TestClientReconcile(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "keep", "tunnel_identifier": "web",
+		 "domain_names": ["a.example.com"], "status": "running"},
+		{"id": "extra", "tunnel_identifier": "api",
+		 "domain_names": ["b.example.com"], "status": "running"},
+		{"id": "down", "tunnel_identifier": "old",
+		 "domain_names": ["c.example.com"], "status": "terminated"}]`
+
+	var mutex sync.Mutex
+	var deleted []string
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET":
+				io.WriteString(w, tunnelsJSON)
+			case "POST":
+				var doc jsonRequest
+				decodeJSON(r.Body, &doc)
+				if *doc.TunnelIdentifier != "mobile" {
+					t.Errorf("Invalid request: %+v\n", doc)
+				}
+				io.WriteString(w, createJSON)
+			case "DELETE":
+				mutex.Lock()
+				deleted = append(deleted, r.URL.Path)
+				mutex.Unlock()
+				io.WriteString(w, `{"jobs_running": 0}`)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var desired = []*Request{
+		{TunnelIdentifier: "web", DomainNames: []string{"a.example.com"}},
+		{
+			TunnelIdentifier: "mobile",
+			DomainNames:      []string{"m.example.com"},
+			NoWait:           true,
+		},
+	}
+
+	created, shutdown, err := client.Reconcile(context.Background(), desired)
+	if err != nil {
+		t.Errorf("client.Reconcile errored %+v\n", err)
+	}
+	if len(created) != 1 ||
+		created[0].Id != "49958ce5ec9f49c796542e0c691455a6" {
+		t.Errorf("Invalid created tunnels: %+v\n", created)
+	}
+	if !reflect.DeepEqual(shutdown, []string{"extra"}) ||
+		!reflect.DeepEqual(deleted, []string{"/username/tunnels/extra"}) {
+		t.Errorf("Invalid shut down tunnels: %v %v\n", shutdown, deleted)
+	}
+}
+
+func TestClientReconcileWithReport(t *testing.T) {
+	var mutex sync.Mutex
+	var deleted []string
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/username/tunnels":
+				io.WriteString(w, `[]`)
+			case r.Method == "GET":
+				io.WriteString(w, `{"id": "slow", "status": "booting"}`)
+			case r.Method == "POST":
+				var doc jsonRequest
+				decodeJSON(r.Body, &doc)
+				fmt.Fprintf(w, `{"id": %q, "status": "new"}`,
+					*doc.TunnelIdentifier)
+			case r.Method == "DELETE":
+				deleted = append(deleted, path.Base(r.URL.Path))
+				io.WriteString(w, `{"jobs_running": 0}`)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:      server.URL,
+		Username:     "username",
+		Password:     "password",
+		PollInterval: time.Millisecond,
+	}
+	var desired = []*Request{
+		{
+			TunnelIdentifier: "fast",
+			DomainNames:      []string{"a.example.com"},
+			NoWait:           true,
+		},
+		{TunnelIdentifier: "slow", DomainNames: []string{"b.example.com"}},
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	report, err := client.ReconcileWithReport(ctx, desired, true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if len(report.Created) != 0 || len(report.Failed) != 0 ||
+		!reflect.DeepEqual(report.Abandoned, []int{1}) ||
+		!reflect.DeepEqual(report.Orphaned, []string{"slow"}) ||
+		!reflect.DeepEqual(report.RolledBack, []string{"fast", "slow"}) {
+		t.Errorf("Invalid report: %+v", report)
+	}
+
+	sort.Strings(deleted)
+	if !reflect.DeepEqual(deleted, []string{"fast", "slow"}) {
+		t.Errorf("Invalid shut down tunnels: %v", deleted)
+	}
+}
+
+func TestDiffTunnelsEmpty(t *testing.T) {
+	var tunnels = []Tunnel{
+		{Id: "1", State: "running", TunnelIdentifier: "web"},
+	}
+
+	toCreate, toShutdown, unchanged := DiffTunnels(nil, tunnels)
+	if len(toCreate) != 0 || len(unchanged) != 0 ||
+		!reflect.DeepEqual(tunnelIds(toShutdown), []string{"1"}) {
+		t.Errorf("Invalid diff: %v %v %v", toCreate, toShutdown, unchanged)
+	}
+
+	toCreate, toShutdown, unchanged = DiffTunnels(tunnels, nil)
+	if len(toShutdown) != 0 || len(unchanged) != 0 ||
+		len(toCreate) != 1 || toCreate[0].TunnelIdentifier != "web" {
+		t.Errorf("Invalid diff: %v %v %v", toCreate, toShutdown, unchanged)
+	}
+}
+
+func TestTunnelString(t *testing.T) {
+	var client = Client{
+		clock: &fakeClock{now: time.Unix(1467690959+3723, 0)},
+	}
+	var tunnel = Tunnel{
+		Client:           &client,
+		Id:               "fakeid",
+		TunnelIdentifier: "sauce",
+		State:            "running",
+		Owner:            "henryprecheur",
+		DomainNames:      []string{"a.example.com", "b.example.com"},
+		CreationTime:     time.Unix(1467690959, 0),
+	}
+
+	var expected = "tunnel fakeid (sauce) running owner=henryprecheur " +
+		"domains=a.example.com,b.example.com age=1h2m3s"
+	if s := fmt.Sprint(tunnel); s != expected {
+		t.Errorf("Invalid string: %s", s)
+	}
+	if s := fmt.Sprintf("%s", &tunnel); s != expected {
+		t.Errorf("Invalid string: %s", s)
+	}
+	if s := fmt.Sprint(Tunnel{Id: "fakeid"}); s != "tunnel fakeid domains=" {
+		t.Errorf("Invalid string: %s", s)
+	}
+	if s := fmt.Sprintf("%#v", tunnel); !strings.HasPrefix(s, "rest.Tunnel{") ||
+		!strings.Contains(s, `Owner:"henryprecheur"`) {
+		t.Errorf("Invalid Go string: %s", s)
+	}
+	if s := fmt.Sprintf("%+v", tunnel); !strings.Contains(s, "Owner:henryprecheur") {
+		t.Errorf("Invalid verbose string: %s", s)
+	}
+}
+
+func TestClientListCached(t *testing.T) {
+	var requests []string
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Header.Get("If-None-Match"))
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, `[{"id": "a", "status": "running"}]`)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	for i := 0; i < 2; i++ {
+		tunnels, err := client.ListCached()
+		if err != nil {
+			t.Errorf("client.ListCached errored %+v\n", err)
+		}
+		if ids := tunnelIds(tunnels); !reflect.DeepEqual(ids, []string{"a"}) {
+			t.Errorf("Invalid tunnels: %v", ids)
+		}
+	}
+	if !reflect.DeepEqual(requests, []string{"", `"v1"`}) {
+		t.Errorf("Invalid requests: %q", requests)
+	}
+}
+
+func TestClientListCreatedBetween(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "creation_time": 1000},
+		{"id": "b", "creation_time": 2000},
+		{"id": "c", "creation_time": 2999},
+		{"id": "d", "creation_time": 3000},
+		{"id": "e", "creation_time": null}]`
+
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(tunnelsJSON)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	tunnels, err := client.ListCreatedBetween(time.Unix(2000, 0), time.Unix(3000, 0))
+	if err != nil {
+		t.Errorf("client.ListCreatedBetween errored %+v\n", err)
+	}
+	if ids := tunnelIds(tunnels); !reflect.DeepEqual(ids, []string{"b", "c"}) {
+		t.Errorf("Invalid tunnels: %v", ids)
+	}
+}
+
+func TestClientFindOrphans(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "tunnel_identifier": "job-1"},
+		{"id": "b", "status": "running", "tunnel_identifier": "job-2"},
+		{"id": "c", "status": "running", "tunnel_identifier": null},
+		{"id": "d", "status": "booting", "tunnel_identifier": "job-3"},
+		{"id": "e", "status": "terminated", "tunnel_identifier": "job-4"}]`
+
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(tunnelsJSON)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var active = []string{"job-1", "job-5"}
+
+	orphans, err := client.FindOrphans(active, false)
+	if err != nil {
+		t.Errorf("client.FindOrphans errored %+v\n", err)
+	}
+	if ids := tunnelIds(orphans); !reflect.DeepEqual(ids, []string{"b", "d"}) {
+		t.Errorf("Invalid orphans: %v", ids)
+	}
+
+	orphans, err = client.FindOrphans(active, true)
+	if err != nil {
+		t.Errorf("client.FindOrphans errored %+v\n", err)
+	}
+	if ids := tunnelIds(orphans); !reflect.DeepEqual(ids, []string{"b", "c", "d"}) {
+		t.Errorf("Invalid orphans: %v", ids)
+	}
+}
+
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes += 1
+	return nil
+}
+
+func TestClientFindOutdated(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running", "metadata": {"build": "2396"}},
+		{"id": "b", "status": "running", "metadata": {"build": 2400}},
+		{"id": "c", "status": "running", "metadata": {"build": 2390}},
+		{"id": "d", "status": "booting", "metadata": {}},
+		{"id": "e", "status": "terminated", "metadata": {"build": "1"}}]`
+
+	var server = multiResponseServer([]R{
+		stringResponse(tunnelsJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	outdated, err := client.FindOutdated(2396)
+	if err != nil {
+		t.Errorf("client.FindOutdated errored %+v\n", err)
+	}
+	if ids := tunnelIds(outdated); !reflect.DeepEqual(ids, []string{"c", "d"}) {
+		t.Errorf("Invalid outdated tunnels: %v", ids)
+	}
+}
+
+func TestClientStreamTunnels(t *testing.T) {
+	const tunnelsJSON = `[
+		{"id": "a", "status": "running"},
+		{"id": "b", "status": "booting"}]`
+
+	var server = httptest.NewServer(http.HandlerFunc(stringResponse(tunnelsJSON)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var w flushCounter
+	if err := client.StreamTunnels(context.Background(), &w); err != nil {
+		t.Errorf("client.StreamTunnels errored %+v\n", err)
+	}
+
+	var lines = strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 2 || w.flushes != 2 {
+		t.Fatalf("Invalid output: %d flushes\n%s", w.flushes, w.String())
+	}
+	for i, id := range []string{"a", "b"} {
+		var tunnel Tunnel
+		if err := json.Unmarshal([]byte(lines[i]), &tunnel); err != nil {
+			t.Errorf("Invalid line %q: %s", lines[i], err)
+		} else if tunnel.Id != id {
+			t.Errorf("Invalid tunnel: %s", tunnel.Id)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.StreamTunnels(ctx, &w); !errors.Is(err, context.Canceled) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse("{ \"jobs_running\": 0 }"),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	_, err := client.Shutdown("fakeid")
+	if err != nil {
+		t.Errorf("client.Shutdown errored %+v\n", err)
+	}
+}
+
+func TestClientShutdownRunning(t *testing.T) {
+	var jobsRunning = 0
+	var server = multiResponseServer([]R{
+		stringResponse(fmt.Sprintf("{ \"jobs_running\": %d }", jobsRunning)),
+	})
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	jobs, err := client.Shutdown("fakeid")
+	if err != nil {
+		t.Errorf("client.Shutdown errored %+v\n", err)
+	}
+	if jobs != jobsRunning {
+		t.Errorf("client.Shutdown did not return proper jobs_runnng value, was %d expected %d",
+			jobsRunning,
+			jobs)
+	}
+}
+
+func TestClientCancelCreate(t *testing.T) {
+	var expected = []string{
+		"GET /username/tunnels/booting",
+		"DELETE /username/tunnels/booting?wait_for_jobs=0",
+		"GET /username/tunnels/running",
+		"DELETE /username/tunnels/running",
+		"GET /username/tunnels/down",
+	}
+	var requests []string
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.RequestURI())
+			switch {
+			case r.Method == "DELETE":
+				io.WriteString(w, `{"jobs_running": 0}`)
+			case strings.HasSuffix(r.URL.Path, "/down"):
+				io.WriteString(w, `{"status": "terminated"}`)
+			default:
+				var status = r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+				fmt.Fprintf(w, `{"status": "%s"}`, status)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	for _, id := range []string{"booting", "running", "down"} {
+		if err := client.CancelCreate(id); err != nil {
+			t.Errorf("client.CancelCreate errored %+v\n", err)
+		}
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Invalid requests: %q", requests)
+	}
+}
+
+func TestClientDrainIdentifier(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "a", "tunnel_identifier": "web", "status": "running"},
+			{"id": "b", "tunnel_identifier": "web", "status": "booting"},
+			{"id": "c", "tunnel_identifier": "api", "status": "running"}]`),
+		stringResponse(`{"jobs_running": 0}`),
+		errorResponse(500, "Internal error"),
+		stringResponse(`[
+			{"id": "a", "tunnel_identifier": "web", "status": "running"},
+			{"id": "c", "tunnel_identifier": "api", "status": "running"}]`),
+		stringResponse(`[
+			{"id": "a", "tunnel_identifier": "web", "status": "terminated"},
+			{"id": "c", "tunnel_identifier": "api", "status": "running"}]`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+
+	var err = client.DrainIdentifier(context.Background(), "web", time.Second)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 500 {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientShutdownMany(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/username/tunnels/a":
+				io.WriteString(w, `{"jobs_running": 0}`)
+			case "/username/tunnels/gone":
+				errorResponse(404, "Not found")(w, r)
+			default:
+				errorResponse(400, "Bad request")(w, r)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var results = client.ShutdownMany(
+		context.Background(), []string{"a", "gone", "bad"}, 2)
+	var apiErr *APIError
+	if len(results) != 3 || results["a"] != nil || results["gone"] != nil ||
+		!errors.As(results["bad"], &apiErr) || apiErr.StatusCode != 400 {
+		t.Errorf("Invalid results: %v", results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = client.ShutdownMany(ctx, []string{"a", "b"}, 1)
+	if results["a"] != context.Canceled || results["b"] != context.Canceled {
+		t.Errorf("Invalid results: %v", results)
+	}
+}
+
+func TestClientShutdown404(t *testing.T) {
+	var server = multiResponseServer([]R{
+		errorResponse(404, "nothing to see here"),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	_, err := client.Shutdown("fakeid")
+	if !strings.HasPrefix(err.Error(), "error querying ") {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+}
+
+const createJSON = `{
+  "status": "new",
+  "direct_domains": null,
+  "vm_version": null,
+  "last_connected": null,
+  "shutdown_time": null,
+  "ssh_port": 443,
+  "launch_time": null,
+  "user_shutdown": null,
+  "use_caching_proxy": null,
+  "creation_time": 1467839998,
+  "domain_names": [
+    "sauce-connect.proxy"
+  ],
+  "shared_tunnel": false,
+  "tunnel_identifier": null,
+  "host": null,
+  "no_proxy_caching": false,
+  "owner": "henryprecheur",
+  "use_kgp": true,
+  "no_ssl_bump_domains": null,
+  "id": "49958ce5ec9f49c796542e0c691455a6",
+  "metadata": {
+    "hostname": "Henry's computer",
+    "git_version": "4a804fd",
+    "platform": "plan9",
     "command": "./sc",
     "build": "Strong",
     "release": "1.2.3",
@@ -445,66 +2237,1686 @@ const createJSON = `{
   }
 }`
 
-const statusRunningJSON = `{"status": "running", "user_shutdown": null}`
+const statusRunningJSON = `{"status": "running", "user_shutdown": null}`
+
+func createTunnel(url string) (Tunnel, error) {
+	var client = Client{
+		BaseURL:  url,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+	return client.CreateWithTimeout(&request, 0)
+}
+
+func TestClientCreate(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+}
+
+func TestClientCreateLabels(t *testing.T) {
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			var doc jsonRequest
+			if err := decodeJSON(r.Body, &doc); err != nil {
+				t.Errorf("decodeJSON errored %+v\n", err)
+			}
+			if doc.Metadata.Labels["team"] != "web" ||
+				doc.Metadata.Release != "1.2.3" {
+				t.Errorf("Invalid metadata: %+v\n", doc.Metadata)
+			}
+			io.WriteString(w, createJSON)
+		},
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		Metadata:    Metadata{Release: "1.2.3"},
+		Labels:      map[string]string{"team": "web"},
+	}
+
+	_, err := client.CreateWithTimeout(&request, 0)
+	if err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+}
+
+func TestClientCreateCommand(t *testing.T) {
+	const command = "orchestrator --job 42 -k ****"
+
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			var doc jsonRequest
+			if err := decodeJSON(r.Body, &doc); err != nil {
+				t.Errorf("decodeJSON errored %+v\n", err)
+			}
+			if doc.Metadata.Command != command {
+				t.Errorf("Invalid command: %q\n", doc.Metadata.Command)
+			}
+			io.WriteString(w, strings.Replace(
+				createJSON, `"command": "./sc"`,
+				`"command": "`+doc.Metadata.Command+`"`, 1))
+		},
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		Metadata:    Metadata{Command: command},
+	}
+
+	tunnel, err := client.CreateWithTimeout(&request, 0)
+	if err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	} else if tunnel.Metadata.Command != command {
+		t.Errorf("Invalid command: %q\n", tunnel.Metadata.Command)
+	}
+}
+
+func TestClientCreateUseKGP(t *testing.T) {
+	for _, useKGP := range []bool{true, false} {
+		var server = multiResponseServer([]R{
+			func(w http.ResponseWriter, r *http.Request) {
+				var doc jsonRequest
+				if err := decodeJSON(r.Body, &doc); err != nil {
+					t.Errorf("decodeJSON errored %+v\n", err)
+				}
+				if doc.UseKGP != useKGP {
+					t.Errorf("Invalid use_kgp: %v", doc.UseKGP)
+				}
+				io.WriteString(w, strings.Replace(createJSON,
+					`"use_kgp": true`,
+					fmt.Sprintf(`"use_kgp": %v`, doc.UseKGP), 1))
+			},
+			stringResponse(statusRunningJSON),
+		})
+
+		var client = Client{
+			BaseURL:  server.URL,
+			Username: "username",
+			Password: "password",
+		}
+		var request = Request{
+			DomainNames: []string{"sauce-connect.proxy"},
+			UseKGP:      &useKGP,
+		}
+
+		tunnel, err := client.CreateWithTimeout(&request, 0)
+		server.Close()
+		if err != nil {
+			t.Errorf("client.createWithTimeout errored %+v\n", err)
+		}
+		if tunnel.UseKGP != useKGP {
+			t.Errorf("Invalid tunnel UseKGP: %v", tunnel.UseKGP)
+		}
+	}
+
+	// KGP is the default
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			var doc jsonRequest
+			decodeJSON(r.Body, &doc)
+			if !doc.UseKGP {
+				t.Errorf("KGP isn't the default")
+			}
+			io.WriteString(w, createJSON)
+		},
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	if _, err := createTunnel(server.URL); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+}
+
+func TestClientCreateNoWait(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		NoWait:      true,
+	}
+
+	tunnel, err := client.Create(&request)
+	if err != nil {
+		t.Errorf("client.Create errored %+v\n", err)
+	}
+	if tunnel.Id != "49958ce5ec9f49c796542e0c691455a6" ||
+		tunnel.State != "new" ||
+		tunnel.ServerStatus != nil {
+		t.Errorf("Invalid tunnel: %+v", tunnel)
+	}
+}
+
+func TestClientCreateStream(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(createJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var requests = []*Request{
+		{DomainNames: []string{"a.example.com"}, NoWait: true},
+		{NoWait: true},
+		{DomainNames: []string{"b.example.com"}, NoWait: true},
+	}
+
+	var results = make(map[int]CreateEvent)
+	for event := range client.CreateStream(context.Background(), requests, 1) {
+		results[event.Index] = event
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Invalid events: %+v\n", results)
+	}
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].Tunnel == nil ||
+			results[i].Tunnel.Id != "49958ce5ec9f49c796542e0c691455a6" {
+			t.Errorf("Invalid event: %+v\n", results[i])
+		}
+	}
+	if results[1].Err != ErrNoDomains || results[1].Tunnel != nil {
+		t.Errorf("Invalid event: %+v\n", results[1])
+	}
+}
+
+func TestClientCreateStreamCancel(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var requests = []*Request{
+		{DomainNames: []string{"a.example.com"}},
+		{DomainNames: []string{"b.example.com"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var count = 0
+	for event := range client.CreateStream(ctx, requests, 2) {
+		count += 1
+		if event.Err != context.Canceled {
+			t.Errorf("Invalid event: %+v\n", event)
+		}
+	}
+	if count != 2 {
+		t.Errorf("Invalid number of events: %d", count)
+	}
+}
+
+func TestClientWaitForStatus(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "running", "id": "fakeid"}`),
+		stringResponse(`{"status": "halting", "id": "fakeid"}`),
+		stringResponse(`{"status": "terminated", "id": "fakeid"}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+
+	tunnel, err := client.WaitForStatus("fakeid", "terminated", time.Minute)
+	if err != nil {
+		t.Errorf("client.WaitForStatus errored %+v\n", err)
+	}
+	if tunnel.Id != "fakeid" || tunnel.State != "terminated" {
+		t.Errorf("Invalid tunnel: %+v", tunnel)
+	}
+}
+
+func TestClientWaitForAnyStatus(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "booting", "id": "fakeid"}`),
+		stringResponse(`{"status": "ready", "id": "fakeid"}`),
+		stringResponse(`{"status": "booting", "id": "fakeid"}`),
+		stringResponse(`{"status": "error", "id": "fakeid"}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var accept = []string{"running", "ready"}
+	var fail = []string{"error", "terminated"}
+
+	tunnel, err := client.WaitForAnyStatus(
+		"fakeid", accept, fail, time.Minute)
+	if err != nil || tunnel.State != "ready" {
+		t.Errorf("Invalid result: %+v, %v", tunnel, err)
+	}
+
+	tunnel, err = client.WaitForAnyStatus(
+		"fakeid", accept, fail, time.Minute)
+	if err == nil || tunnel.State != "error" ||
+		err.Error() != "Tunnel fakeid is error, expected running or ready" {
+		t.Errorf("Invalid result: %+v, %v", tunnel, err)
+	}
+}
+
+func TestClientClaimDomains(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "a", "status": "terminated",
+			 "domain_names": ["sauce-connect.proxy"]},
+			{"id": "b", "status": "running",
+			 "domain_names": ["sauce-connect.proxy"]}]`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	tunnel, created, err := client.ClaimDomains(&request)
+	if err != nil {
+		t.Errorf("client.ClaimDomains errored %+v\n", err)
+	}
+	if created || tunnel.Id != "b" {
+		t.Errorf("Invalid tunnel: %v %+v", created, tunnel)
+	}
+}
+
+func TestClientClaimDomainsCreate(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[{"id": "a", "status": "running",
+			"domain_names": ["other.proxy"]}]`),
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	tunnel, created, err := client.ClaimDomains(&request)
+	if err != nil {
+		t.Fatalf("client.ClaimDomains errored %+v\n", err)
+	}
+	// Stop the status loops of the tunnel
+	defer client.Close()
+	if !created || tunnel.Id != "49958ce5ec9f49c796542e0c691455a6" {
+		t.Errorf("Invalid tunnel: %v %+v", created, tunnel)
+	}
+}
+
+func TestClientCreateTooLarge(t *testing.T) {
+	var server = multiResponseServer([]R{
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:         server.URL,
+		Username:        "username",
+		Password:        "password",
+		MaxRequestBytes: 1024,
+	}
+	var request = Request{}
+	for i := 0; i < 100; i++ {
+		request.DomainNames = append(request.DomainNames,
+			fmt.Sprintf("host%d.example.com", i))
+	}
+
+	_, err := client.CreateWithTimeout(&request, 0)
+	if !errors.Is(err, ErrRequestTooLarge) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientCreateNoDomains(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var request = Request{}
+	if _, err := client.CreateWithTimeout(&request, 0); err != ErrNoDomains {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	request.AllowNoDomains = true
+	if _, err := client.CreateWithTimeout(&request, 0); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+}
+
+func TestRequestValidateRegionHint(t *testing.T) {
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		RegionHint:  "us-east",
+	}
+
+	if err := request.Validate(); err != ErrRegionHintUnsupported {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestRequestValidateUniqueIdentifier(t *testing.T) {
+	var request = Request{
+		DomainNames:      []string{"sauce-connect.proxy"},
+		UniqueIdentifier: true,
+	}
+
+	if err := request.Validate(); err != ErrNoIdentifier {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	request.TunnelIdentifier = "my-tunnel"
+	if err := request.Validate(); err != nil {
+		t.Errorf("request.Validate errored %+v\n", err)
+	}
+}
+
+func TestRequestValidateDomains(t *testing.T) {
+	var tests = []struct {
+		domain string
+		reason string
+	}{
+		{"sauce-connect.proxy", ""},
+		{"*.example.com", ""},
+		{"Example-1.COM", ""},
+		{"", "empty name"},
+		{"a..example.com", "empty label"},
+		{"*example.com", "wildcard"},
+		{"a.*.example.com", "wildcard"},
+		{"-a.example.com", "hyphen"},
+		{"a_b.example.com", "invalid character '_'"},
+		{"http://example.com", "invalid character ':'"},
+		{strings.Repeat("a", 64) + ".com", "longer than 63"},
+	}
+
+	for _, test := range tests {
+		var request = Request{DomainNames: []string{test.domain}}
+		var err = request.Validate()
+
+		var domainErr *InvalidDomainError
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", test.domain, err)
+			}
+		} else if !errors.As(err, &domainErr) ||
+			!errors.Is(err, ErrInvalidDomain) ||
+			domainErr.Domain != test.domain ||
+			!strings.Contains(domainErr.Reason, test.reason) {
+			t.Errorf("%q: invalid error %v", test.domain, err)
+		}
+	}
+}
+
+func TestClientCreateUniqueIdentifier(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "old", "tunnel_identifier": "web", "status": "terminated"},
+			{"id": "other", "tunnel_identifier": "api", "status": "running"}
+		]`),
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+		stringResponse(`[
+			{"id": "booting", "tunnel_identifier": "web", "status": "booting"}
+		]`),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		TunnelIdentifier: "web",
+		DomainNames:      []string{"sauce-connect.proxy"},
+		UniqueIdentifier: true,
+	}
+
+	if _, err := client.CreateWithTimeout(&request, 0); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+
+	_, err := client.CreateWithTimeout(&request, 0)
+	var inUse *IdentifierInUseError
+	if !errors.Is(err, ErrIdentifierInUse) ||
+		!errors.As(err, &inUse) || inUse.TunnelId != "booting" {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientCreateWithFallbackIdentifier(t *testing.T) {
+	var identifiers []string
+	var wedged = false
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var doc struct {
+				TunnelIdentifier string `json:"tunnel_identifier"`
+			}
+			json.NewDecoder(r.Body).Decode(&doc)
+			identifiers = append(identifiers, doc.TunnelIdentifier)
+
+			if len(identifiers) == 1 || wedged {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"code": "tunnel_identifier_wedged",
+					"message": "tunnel identifier web is wedged"}`)
+			} else {
+				fmt.Fprint(w, createJSON)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		TunnelIdentifier: "web",
+		DomainNames:      []string{"sauce-connect.proxy"},
+		NoWait:           true,
+	}
+
+	_, identifier, err := client.CreateWithFallbackIdentifier(&request)
+	if err != nil {
+		t.Errorf("client.CreateWithFallbackIdentifier errored %+v\n", err)
+	}
+	if len(identifiers) != 2 || identifiers[0] != "web" ||
+		identifiers[1] != identifier ||
+		!strings.HasPrefix(identifier, "web-") {
+		t.Errorf("Invalid identifiers: %q, used %q", identifiers, identifier)
+	}
+	if request.TunnelIdentifier != "web" {
+		t.Errorf("The request was modified: %+v", request)
+	}
+
+	// The new identifier is returned even if it failed too
+	identifiers = nil
+	wedged = true
+	_, identifier, err = client.CreateWithFallbackIdentifier(
+		&request, WithTimeout(time.Minute))
+	if err == nil {
+		t.Errorf("client.CreateWithFallbackIdentifier didn't error")
+	}
+	if len(identifiers) != 2 || identifiers[1] != identifier {
+		t.Errorf("Invalid identifiers: %q, used %q", identifiers, identifier)
+	}
+}
+
+func TestClientCreateWithFallbackIdentifierNotRetried(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "live", "tunnel_identifier": "web", "status": "running"}
+		]`),
+		errorResponse(400, `{"error": "invalid identifier for domains"}`),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var request = Request{
+		TunnelIdentifier: "web",
+		DomainNames:      []string{"sauce-connect.proxy"},
+		UniqueIdentifier: true,
+		NoWait:           true,
+	}
+
+	// The identifier belongs to a live tunnel
+	_, identifier, err := client.CreateWithFallbackIdentifier(&request)
+	if !errors.Is(err, ErrIdentifierInUse) || identifier != "web" {
+		t.Errorf("Invalid error: %v, used %q", err, identifier)
+	}
+
+	// The error doesn't name the identifier field
+	request.UniqueIdentifier = false
+	_, identifier, err = client.CreateWithFallbackIdentifier(&request)
+	if err == nil || identifier != "web" {
+		t.Errorf("Invalid error: %v, used %q", err, identifier)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+		stringResponse(`{"jobs_running": 0}`),
+		errorResponse(429, "Too many tunnels"),
+	})
+	defer server.Close()
+
+	var events = make(chan LifecycleEvent, 10)
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Events:   events,
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	tunnel, err := client.CreateWithTimeout(&request, time.Minute)
+	if err != nil {
+		t.Errorf("client.CreateWithTimeout errored %+v\n", err)
+	}
+	if _, err = client.Shutdown(tunnel.Id); err != nil {
+		t.Errorf("client.Shutdown errored %+v\n", err)
+	}
+	if _, err = client.CreateWithTimeout(&request, time.Minute); err == nil {
+		t.Errorf("client.CreateWithTimeout didn't fail")
+	}
+	close(events)
+
+	var received []string
+	for event := range events {
+		received = append(received,
+			fmt.Sprintf("%s %s %s", event.TunnelId, event.Event, event.Status))
+	}
+	var expected = []string{
+		tunnel.Id + " created new",
+		tunnel.Id + " running running",
+		tunnel.Id + " shutdown ",
+		" failed ",
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Invalid events: %q", received)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(`{"status": "booting", "user_shutdown": null}`),
+		stringResponse(statusRunningJSON),
+		errorResponse(429, "Too many tunnels"),
+		stringResponse(createJSON),
+		stringResponse(`{"status": "booting", "user_shutdown": null}`),
+		stringResponse(`{"status": "booting", "user_shutdown": null}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	if _, err := client.CreateWithTimeout(&request, time.Minute); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+	if _, err := client.CreateWithTimeout(&request, 0); err == nil {
+		t.Errorf("client.createWithTimeout didn't error")
+	}
+	if _, err := client.CreateWithTimeout(&request, 0); err == nil {
+		t.Errorf("client.createWithTimeout didn't error")
+	}
+
+	var expected = Stats{
+		CreatesAttempted: 3,
+		CreatesSucceeded: 1,
+		CreatesFailed:    2,
+		FailedRejected:   1,
+		FailedTimeout:    1,
+		AverageBootTime:  time.Second,
+	}
+	if stats := client.Stats(); stats != expected {
+		t.Errorf("Invalid stats: %+v\n", stats)
+	}
+
+	client.ResetStats()
+	if stats := client.Stats(); stats != (Stats{}) {
+		t.Errorf("Invalid stats: %+v\n", stats)
+	}
+}
+
+func TestClientStatsWaitErrors(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		errorResponse(404, "Not found"),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	// The REST API accepted the tunnel, the error of the status query
+	// isn't a rejection
+	if _, err := client.CreateWithTimeout(&request, time.Minute); err == nil {
+		t.Errorf("client.createWithTimeout didn't error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.create(&request, 0, WithContext(ctx)); err == nil {
+		t.Errorf("client.create didn't error")
+	}
+
+	var expected = Stats{
+		CreatesAttempted: 2,
+		CreatesFailed:    2,
+		FailedOther:      2,
+	}
+	if stats := client.Stats(); stats != expected {
+		t.Errorf("Invalid stats: %+v\n", stats)
+	}
+}
+
+func TestClientCreateSlowWarning(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(`{"id": "fakeid", "status": "booting"}`),
+		stringResponse(`{"id": "fakeid", "status": "booting"}`),
+		stringResponse(`{"id": "fakeid", "status": "deploying"}`),
+		stringResponse(`{"id": "fakeid", "status": "deploying"}`),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var warnings []string
+	var request = Request{
+		DomainNames:     []string{"sauce-connect.proxy"},
+		SlowCreateAfter: 2 * time.Second,
+		OnSlowCreate: func(elapsed time.Duration, lastStatus string) {
+			warnings = append(warnings,
+				fmt.Sprintf("%s %s", elapsed, lastStatus))
+		},
+	}
+
+	if _, err := client.CreateWithTimeout(&request, time.Minute); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+	if len(warnings) != 1 || warnings[0] != "2s deploying" {
+		t.Errorf("Invalid warnings: %q", warnings)
+	}
+}
+
+func TestClientCreateReadyWhen(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(`{"id": "fakeid", "status": "running",
+			"last_connected": null}`),
+		stringResponse(`{"id": "fakeid", "status": "running",
+			"last_connected": 1467691618}`),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		ReadyWhen: func(tunnel *Tunnel) bool {
+			return !tunnel.LastConnected.IsZero()
+		},
+	}
+
+	if _, err := client.CreateWithTimeout(&request, time.Minute); err != nil {
+		t.Errorf("client.CreateWithTimeout errored %+v\n", err)
+	}
+}
+
+func TestClientCreateSharedWarning(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`[
+			{"id": "shared", "status": "running", "owner": "teammate",
+			 "shared_tunnel": true, "domain_names": ["sauce-connect.proxy"]},
+			{"id": "private", "status": "running",
+			 "shared_tunnel": false, "domain_names": ["sauce-connect.proxy"]},
+			{"id": "other", "status": "running",
+			 "shared_tunnel": true, "domain_names": ["other.example.com"]}]`),
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var warnings []Warning
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+		OnWarning: func(warning Warning) {
+			warnings = append(warnings, warning)
+		},
+	}
+
+	if _, err := client.CreateWithTimeout(&request, 0); err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+	if len(warnings) != 1 || warnings[0].TunnelId != "shared" ||
+		!strings.Contains(warnings[0].Message, "owned by teammate") {
+		t.Errorf("Invalid warnings: %+v", warnings)
+	}
+}
+
+func TestClientCreateHTTPError(t *testing.T) {
+	var server = multiResponseServer([]R{
+		errorResponse(504, "Not available"),
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if err == nil {
+		t.Errorf("client.createWithTimeout didn't error")
+	}
+
+	if !(strings.HasPrefix(err.Error(), "error querying ") &&
+		strings.HasSuffix(err.Error(), "504 Gateway Timeout")) {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+}
+
+func TestClientCreateError(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse("ERROR!"),
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if err == nil {
+		t.Fatalf("client.createWithTimeout didn't error")
+	}
+
+	if !strings.HasPrefix(err.Error(), "couldn't decode JSON document: ") {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+}
+
+func TestClientCreateRejected(t *testing.T) {
+	var responses = []string{
+		`{"error": "Tunnel limit reached"}`,
+		`{"error": {"code": 42}, "id": "fakeid", "status": "new"}`,
+		`{"status": "new"}`,
+		`{}`,
+	}
+
+	for _, response := range responses {
+		var server = multiResponseServer([]R{
+			stringResponse(response),
+			stringResponse(statusRunningJSON),
+		})
+
+		_, err := createTunnel(server.URL)
+		server.Close()
+
+		if !errors.Is(err, ErrCreateRejected) {
+			t.Errorf("Invalid error for %s: %v", response, err)
+		}
+	}
+
+	var server = multiResponseServer([]R{
+		stringResponse(`{"error": "Tunnel limit reached"}`),
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if err.Error() != "tunnel creation rejected: Tunnel limit reached" {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+}
+
+func TestClientCreateNoCapacity(t *testing.T) {
+	var server = multiResponseServer([]R{
+		errorResponse(429, "Too many tunnels"),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		},
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != 429 ||
+		apiErr.Message != "Too many tunnels" {
+		t.Errorf("Invalid API error: %+v", apiErr)
+	}
+}
+
+func TestAPIErrorRequestID(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-Id", "0123abcd")
+			errorResponse(500, "Internal error")(w, r)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var _, err = client.GetTunnel("fakeid")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.RequestID != "0123abcd" {
+		t.Errorf("Invalid API error: %+v", apiErr)
+	}
+	if !strings.HasSuffix(err.Error(), "(request id: 0123abcd)") {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientCreateConnectionLost(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatalf("Hijack errored %+v\n", err)
+			}
+			io.WriteString(conn, "garbage\r\n\r\n")
+			conn.Close()
+		},
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	tunnel, err := client.CreateWithTimeout(&request, time.Minute)
+	if err != nil {
+		t.Errorf("client.createWithTimeout errored %+v\n", err)
+	}
+	if tunnel.Id != "49958ce5ec9f49c796542e0c691455a6" ||
+		tunnel.State != "running" {
+		t.Errorf("Invalid tunnel: %+v\n", tunnel)
+	}
+}
+
+func TestClientCreateWaitError(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(`{"status": "shutdown", "user_shutdown": null}`),
+	})
+	defer server.Close()
+
+	_, err := createTunnel(server.URL)
+	if err == nil {
+		t.Errorf("client.createWithTimeout didn't error")
+	}
+	// go 1.7 adds an s after the # of seconds, previous versions don't have the s
+	if !(strings.HasPrefix(err.Error(), "Tunnel ") &&
+		(strings.HasSuffix(err.Error(), " didn't come up after 0s")) ||
+		strings.HasSuffix(err.Error(), " didn't come up after 0")) {
+		t.Errorf("Invalid error: %s", err.Error())
+	}
+}
+
+func TestClientCreateTimeout(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			if requests == 1 {
+				io.WriteString(w, createJSON)
+			} else {
+				io.WriteString(w, `{"status": "booting"}`)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{now: time.Unix(1467839998, 0)},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	_, err := client.CreateWithTimeout(&request, time.Minute)
+	if err == nil ||
+		!strings.HasSuffix(err.Error(), " didn't come up after 1m0s") {
+		t.Errorf("Invalid error: %v", err)
+	}
+	// One creation request, then one status request per second until the
+	// deadline has passed
+	if requests != 1+62 {
+		t.Errorf("Invalid number of requests: %d", requests)
+	}
+}
+
+func TestClientWaitForDomainReady(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "booting", "user_shutdown": null}`),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+
+	var probes = 0
+	var probe = func(ctx context.Context) error {
+		probes += 1
+		if probes < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	var err = client.WaitForDomainReady(
+		context.Background(), "fakeid", probe, time.Second)
+	if err != nil {
+		t.Errorf("client.WaitForDomainReady errored %+v\n", err)
+	}
+	if probes != 3 {
+		t.Errorf("Invalid number of probes: %d", probes)
+	}
+}
+
+func TestClientWaitForDomainReadyTimeout(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var probe = func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}
+
+	var err = client.WaitForDomainReady(ctx, "fakeid", probe, time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) ||
+		!strings.HasSuffix(err.Error(), "(last probe error: connection refused)") {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientWaitForDomainReadyDown(t *testing.T) {
+	var server = multiResponseServer([]R{
+		stringResponse(`{"status": "terminated", "user_shutdown": null}`),
+	})
+	defer server.Close()
 
-func createTunnel(url string) (Tunnel, error) {
 	var client = Client{
-		BaseURL:  url,
+		BaseURL:  server.URL,
 		Username: "username",
 		Password: "password",
 	}
-	var request = Request{
-		DomainNames: []string{"sauce-connect.proxy"},
+
+	var probe = func(ctx context.Context) error {
+		t.Errorf("Probed a tunnel that's down")
+		return nil
+	}
+
+	var err = client.WaitForDomainReady(
+		context.Background(), "fakeid", probe, time.Millisecond)
+	if err == nil || err.Error() != "Tunnel fakeid is down: terminated" {
+		t.Errorf("Invalid error: %v", err)
 	}
-	return client.CreateWithTimeout(&request, 0)
 }
 
-func TestClientCreate(t *testing.T) {
+func TestClientWaitForBuild(t *testing.T) {
 	var server = multiResponseServer([]R{
-		stringResponse(createJSON),
-		stringResponse(statusRunningJSON),
+		stringResponse(`{"status": "running", "metadata": {"build": "2396"}}`),
+		stringResponse(`{"status": "running", "metadata": {"build": null}}`),
+		stringResponse(`{"status": "running", "metadata": {"build": 2400}}`),
 	})
 	defer server.Close()
 
-	_, err := createTunnel(server.URL)
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+
+	var err = client.WaitForBuild(
+		context.Background(), "fakeid", 2400, time.Second)
 	if err != nil {
-		t.Errorf("client.createWithTimeout errored %+v\n", err)
+		t.Errorf("client.WaitForBuild errored %+v\n", err)
 	}
 }
 
-func TestClientCreateHTTPError(t *testing.T) {
+func TestClientWaitForBuildTimeout(t *testing.T) {
 	var server = multiResponseServer([]R{
-		errorResponse(504, "Not available"),
+		stringResponse(`{"status": "running", "metadata": {"build": "2396"}}`),
 	})
 	defer server.Close()
 
-	_, err := createTunnel(server.URL)
-	if err == nil {
-		t.Errorf("client.createWithTimeout didn't error")
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
 	}
 
-	if !(strings.HasPrefix(err.Error(), "error querying ") &&
-		strings.HasSuffix(err.Error(), "504 Gateway Timeout")) {
-		t.Errorf("Invalid error: %s", err.Error())
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var err = client.WaitForBuild(ctx, "fakeid", 2400, time.Second)
+	if !errors.Is(err, context.DeadlineExceeded) ||
+		!strings.HasSuffix(err.Error(), "(last build: 2396)") {
+		t.Errorf("Invalid error: %v", err)
 	}
 }
 
-func TestClientCreateWaitError(t *testing.T) {
+func TestClientCreateTimeoutSettings(t *testing.T) {
+	var requests = 0
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			if requests == 1 {
+				io.WriteString(w, createJSON)
+			} else {
+				io.WriteString(w, `{"status": "booting"}`)
+			}
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:       server.URL,
+		Username:      "username",
+		Password:      "password",
+		CreateTimeout: 5 * time.Second,
+		PollInterval:  2 * time.Second,
+		clock:         &fakeClock{},
+	}
+	var request = Request{
+		DomainNames: []string{"sauce-connect.proxy"},
+	}
+
+	_, err := client.Create(&request)
+	if err == nil ||
+		!strings.HasSuffix(err.Error(), " didn't come up after 5s") {
+		t.Errorf("Invalid error: %v", err)
+	}
+	// Status requests at 0, 2, 4 & 6 seconds
+	if requests != 1+4 {
+		t.Errorf("Invalid number of requests: %d", requests)
+	}
+}
+
+func TestClientHealthCheck(t *testing.T) {
+	var server = multiResponseServer([]R{
+		jsonResponse(`{"service_operational": true, "status_message": "OK"}`),
+		stringResponse(`<html>Sign in to the Wi-Fi</html>`),
+		jsonResponse(`{"status": "running"}`),
+		errorResponse(404, "Not found"),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var ctx = context.Background()
+
+	if err := client.HealthCheck(ctx); err != nil {
+		t.Errorf("client.HealthCheck errored %+v\n", err)
+	}
+
+	var decodeErr *DecodeError
+	if err := client.HealthCheck(ctx); !errors.As(err, &decodeErr) ||
+		!decodeErr.Transient {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if err := client.HealthCheck(ctx); !errors.As(err, &decodeErr) ||
+		decodeErr.Transient {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	var apiErr *APIError
+	if err := client.HealthCheck(ctx); !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != 404 {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	server.Close()
+	var connectErr *ConnectError
+	if err := client.HealthCheck(ctx); !errors.As(err, &connectErr) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+// Clock advancing by the next of `steps` each time it's read
+type steppingClock struct {
+	fakeClock
+	steps []time.Duration
+}
+
+func (c *steppingClock) Now() time.Time {
+	if len(c.steps) > 0 {
+		c.now = c.now.Add(c.steps[0])
+		c.steps = c.steps[1:]
+	}
+	return c.now
+}
+
+func TestClientMeasureLatency(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		jsonResponse(`{"service_operational": true}`)))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL: server.URL,
+		clock: &steppingClock{steps: []time.Duration{
+			0, 30 * time.Millisecond,
+			0, 10 * time.Millisecond,
+			0, 20 * time.Millisecond,
+		}},
+	}
+
+	min, avg, max, err := client.MeasureLatency(context.Background(), 3)
+	if err != nil {
+		t.Errorf("client.MeasureLatency errored %+v\n", err)
+	}
+	if min != 10*time.Millisecond ||
+		avg != 20*time.Millisecond ||
+		max != 30*time.Millisecond {
+		t.Errorf("Invalid latency: %s %s %s", min, avg, max)
+	}
+
+	server.Close()
+	_, _, _, err = client.MeasureLatency(context.Background(), 3)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientContextValue(t *testing.T) {
+	type traceKey struct{}
+
+	var headers []string
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers = append(headers, r.Header.Get("X-Trace-Id"))
+			fmt.Fprint(w, `[]`)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		ContextValue: func(ctx context.Context) (string, bool) {
+			id, ok := ctx.Value(traceKey{}).(string)
+			return id, ok
+		},
+		ContextHeader: "X-Trace-Id",
+	}
+
+	var ctx = context.WithValue(context.Background(), traceKey{}, "trace-1")
+	if _, err := client.List(WithContext(ctx)); err != nil {
+		t.Errorf("client.List errored %+v\n", err)
+	}
+	if _, err := client.List(); err != nil {
+		t.Errorf("client.List errored %+v\n", err)
+	}
+	if !reflect.DeepEqual(headers, []string{"trace-1", ""}) {
+		t.Errorf("Invalid headers: %q", headers)
+	}
+}
+
+func TestClientLogf(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		stringResponse(createJSON)))
+	defer server.Close()
+
+	var lines []string
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Logf: func(format string, v ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, v...))
+		},
+		LogBodies: true,
+	}
+	var request = Request{
+		TunnelIdentifier: "secret-identifier",
+		DomainNames:      []string{"sauce-connect.proxy"},
+		NoWait:           true,
+	}
+
+	if _, err := client.Create(&request); err != nil {
+		t.Errorf("client.Create errored %+v\n", err)
+	}
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], `Authorization="REDACTED"`) ||
+		!strings.Contains(lines[0], "secret-identifier") ||
+		!strings.HasSuffix(lines[1], ": 200 OK") {
+		t.Errorf("Invalid log: %q", lines)
+	}
+
+	// The credentials are redacted even if Redact doesn't call DefaultRedact
+	lines = nil
+	client.Redact = func(key, value string) string {
+		if key == "Body" {
+			return strings.ReplaceAll(value, "secret-identifier", "***")
+		}
+		return value
+	}
+
+	if _, err := client.Create(&request); err != nil {
+		t.Errorf("client.Create errored %+v\n", err)
+	}
+	if len(lines) != 2 || strings.Contains(lines[0], "secret-identifier") ||
+		strings.Contains(lines[0], "Basic ") {
+		t.Errorf("Invalid log: %q", lines)
+	}
+}
+
+func TestClientWithCredentials(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			username, password, _ := r.BasicAuth()
+			if username != "tenant" || password != "secret" ||
+				r.URL.Path != "/tenant/tunnels/fakeid" {
+				t.Errorf("Invalid request: %s %s (%s:%s)",
+					r.Method, r.URL, username, password)
+			}
+			io.WriteString(w, statusRunningJSON)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	client.Close()
+
+	var tenant = client.WithCredentials("tenant", "secret")
+	if client.Username != "username" || client.Password != "password" {
+		t.Errorf("Original client modified: %+v", client)
+	}
+
+	if _, err := tenant.GetTunnel("fakeid"); err != nil {
+		t.Errorf("tenant.GetTunnel errored %+v\n", err)
+	}
+
+	// The pinned transport is shared too
+	var pinned = Client{
+		BaseURL:          server.URL,
+		PinnedCertSHA256: [][]byte{make([]byte, 32)},
+	}
+	tenant = pinned.WithCredentials("tenant", "secret")
+	if transport := tenant.getState().transport; transport == nil ||
+		transport != pinned.getState().transport {
+		t.Errorf("The pinned transport isn't shared: %p", transport)
+	}
+}
+
+func TestClientMaxConcurrency(t *testing.T) {
+	var started = make(chan struct{})
+	var release = make(chan struct{})
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			io.WriteString(w, statusRunningJSON)
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:        server.URL,
+		Username:       "username",
+		Password:       "password",
+		MaxConcurrency: 1,
+	}
+
+	var done = make(chan error)
+	go func() {
+		_, err := client.GetTunnel("fakeid")
+		done <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.GetTunnel("fakeid", WithContext(ctx))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	client.FailWhenSaturated = true
+	if _, err := client.GetTunnel("fakeid"); err != ErrSaturated {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+}
+
+func TestClientDialContext(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(
+		stringResponse(statusRunningJSON)))
+	defer server.Close()
+
+	var dials = 0
+	var dialer net.Dialer
+	var client = Client{
+		// The server isn't reachable without the dialer
+		BaseURL:  "http://rest.example.test",
+		Username: "username",
+		Password: "password",
+		Client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (
+					net.Conn, error,
+				) {
+					dials += 1
+					return dialer.DialContext(
+						ctx, network, server.Listener.Addr().String())
+				},
+			},
+		},
+	}
+
+	if _, err := client.GetTunnel("fakeid"); err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+	if dials != 1 {
+		t.Errorf("Invalid number of dials: %d", dials)
+	}
+}
+
+func TestClientOnTimings(t *testing.T) {
+	var server = httptest.NewTLSServer(http.HandlerFunc(
+		stringResponse(statusRunningJSON)))
+	defer server.Close()
+
+	var mutex sync.Mutex
+	var phases = make(map[string]int)
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Client:   *server.Client(),
+		OnTimings: func(phase string, d time.Duration) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			phases[phase] += 1
+		},
+	}
+
+	if _, err := client.GetTunnel("fakeid"); err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+	var expected = map[string]int{"connect": 1, "tls": 1, "ttfb": 1}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("Invalid phases: %v", phases)
+	}
+}
+
+func TestClientPinnedCertificate(t *testing.T) {
+	var server = httptest.NewTLSServer(http.HandlerFunc(
+		stringResponse(statusRunningJSON)))
+	defer server.Close()
+
+	var fingerprint = sha256.Sum256(server.Certificate().Raw)
+	var client = Client{
+		BaseURL:          server.URL,
+		Username:         "username",
+		Password:         "password",
+		Client:           *server.Client(),
+		PinnedCertSHA256: [][]byte{fingerprint[:]},
+	}
+
+	if _, err := client.GetTunnel("fakeid"); err != nil {
+		t.Errorf("client.GetTunnel errored %+v\n", err)
+	}
+
+	var other = sha256.Sum256([]byte("another certificate"))
+	client = Client{
+		BaseURL:          server.URL,
+		Username:         "username",
+		Password:         "password",
+		Client:           *server.Client(),
+		PinnedCertSHA256: [][]byte{other[:]},
+	}
+
+	_, err := client.GetTunnel("fakeid")
+	if !errors.Is(err, ErrCertificateNotPinned) {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	var started = make(chan bool)
+	var server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-r.Context().Done()
+		}))
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+
+	var result = make(chan error)
+	go func() {
+		_, err := client.GetTunnel("fakeid")
+		result <- err
+	}()
+
+	<-started
+	client.Close()
+	var err = <-result
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("In-flight request wasn't canceled: %v", err)
+	}
+
+	// Closing twice is fine
+	client.Close()
+
+	if _, err := client.GetTunnel("fakeid"); err != ErrClosed {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestClientCloseStopsLoops(t *testing.T) {
 	var server = multiResponseServer([]R{
 		stringResponse(createJSON),
-		stringResponse(`{"status": "shutdown", "user_shutdown": null}`),
+		stringResponse(statusRunningJSON),
 	})
 	defer server.Close()
 
-	_, err := createTunnel(server.URL)
-	if err == nil {
-		t.Errorf("client.createWithTimeout didn't error")
+	tunnel, err := createTunnel(server.URL)
+	if err != nil {
+		t.Fatalf("client.createWithTimeout errored %+v\n", err)
 	}
-	// go 1.7 adds an s after the # of seconds, previous versions don't have the s
-	if !(strings.HasPrefix(err.Error(), "Tunnel ") &&
-		(strings.HasSuffix(err.Error(), " didn't come up after 0s")) ||
-		strings.HasSuffix(err.Error(), " didn't come up after 0")) {
-		t.Errorf("Invalid error: %s", err.Error())
+
+	var done = make(chan bool)
+	go func() {
+		tunnel.serverStatusLoop(time.Hour)
+		done <- true
+	}()
+	go func() {
+		tunnel.heartbeatLoop(time.Hour)
+		done <- true
+	}()
+
+	tunnel.Client.Close()
+	<-done
+	<-done
+}
+
+func TestTunnelProbeURL(t *testing.T) {
+	var proxy = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Host == "app.example.test" {
+				io.WriteString(w, "OK")
+			} else {
+				http.Error(w, "Bad gateway", 502)
+			}
+		}))
+	defer proxy.Close()
+
+	var closed = httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	var tunnel = Tunnel{Id: "fakeid"}
+	var ctx = context.Background()
+
+	if err := tunnel.ProbeURL(
+		ctx, proxy.URL, "http://app.example.test/", nil); err != nil {
+		t.Errorf("tunnel.ProbeURL errored %+v\n", err)
+	}
+
+	var apiErr *APIError
+	var err = tunnel.ProbeURL(ctx, proxy.URL, "http://other.test/", nil)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 502 ||
+		!strings.Contains(err.Error(), "request failed") {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	var connectErr *ConnectError
+	err = tunnel.ProbeURL(ctx, closed.URL, "http://app.example.test/", nil)
+	if !errors.As(err, &connectErr) ||
+		!strings.Contains(err.Error(), "connection failed") {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	var dnsErr *net.DNSError
+	err = tunnel.ProbeURL(
+		ctx, "http://proxy.invalid:8080", "http://app.example.test/", nil)
+	if !errors.As(err, &dnsErr) ||
+		!strings.Contains(err.Error(), "DNS lookup failed") {
+		t.Errorf("Invalid error: %v", err)
 	}
 }
 
@@ -573,6 +3985,48 @@ func TestTunnelLoop(t *testing.T) {
 	}
 }
 
+func TestTunnelKeepAlive(t *testing.T) {
+	var pings = 0
+	var server = multiResponseServer([]R{
+		stringResponse(`{"id": "fakeid", "status": "running"}`),
+		func(w http.ResponseWriter, r *http.Request) {
+			pings += 1
+			io.WriteString(w, `{"result": true}`)
+		},
+		stringResponse(`{"id": "fakeid", "status": "error"}`),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+	}
+	var tunnel = Tunnel{Client: &client, Id: "fakeid"}
+
+	var reasons = make(chan KeepAliveStop, 1)
+	var stop = tunnel.KeepAlive(time.Millisecond, func(reason KeepAliveStop) {
+		reasons <- reason
+	})
+	defer stop()
+
+	if reason := <-reasons; reason != StoppedTunnelDown {
+		t.Errorf("Invalid reason: %v", reason)
+	}
+	if pings != 1 {
+		t.Errorf("Invalid number of heartbeats: %d", pings)
+	}
+
+	stop = tunnel.KeepAlive(time.Hour, func(reason KeepAliveStop) {
+		reasons <- reason
+	})
+	stop()
+	stop()
+	if reason := <-reasons; reason != StoppedByCaller {
+		t.Errorf("Invalid reason: %v", reason)
+	}
+}
+
 func heartbeatChecker(
 	connected bool,
 	changeDuration int64,
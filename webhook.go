@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Number of times a failed webhook is retried, see Request.ReadyWebhook
+const webhookRetries = 2
+
+// Maximum duration of one webhook attempt, the creation waits for the webhook
+var webhookTimeout = 10 * time.Second
+
+//
+// Document posted to Request.ReadyWebhook. Event is "running" when the tunnel
+// came up, or "failed" with the error when the creation failed. Tunnel is
+// empty if the REST API didn't create the tunnel.
+//
+type WebhookPayload struct {
+	Event  string `json:"event"`
+	Tunnel Tunnel `json:"tunnel"`
+	Error  string `json:"error,omitempty"`
+}
+
+//
+// Post the outcome of a creation to `url`. Failures are logged with
+// Client.Logf, never returned: the webhook is only a notification. Connection
+// errors and 5xx statuses are retried webhookRetries times, Client.RetryDelay
+// apart, until `ctx` is done. Each attempt is canceled after webhookTimeout,
+// so a webhook that never answers doesn't stall the creation.
+//
+// The webhook is the caller's, not the REST API: it's posted with Client.Client
+// as-is, without the certificates pinned by PinnedCertSHA256.
+//
+func (c *Client) notifyWebhook(
+	ctx context.Context,
+	url string,
+	tunnel Tunnel,
+	err error,
+) {
+	var payload = WebhookPayload{Event: "running", Tunnel: tunnel}
+	if err != nil {
+		payload.Event = "failed"
+		payload.Error = err.Error()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		c.logWebhook(url, err)
+		return
+	}
+	var delay = c.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postWebhook(ctx, url, body)
+		if err == nil {
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+
+		if attempt >= webhookRetries ||
+			resp != nil && resp.StatusCode < http.StatusInternalServerError {
+			c.logWebhook(url, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			c.logWebhook(url, ctx.Err())
+			return
+		case <-c.getClock().After(delay):
+		}
+	}
+}
+
+//
+// Make one attempt to post `body` to `url`, within webhookTimeout. The body
+// of the response is already closed.
+//
+func (c *Client) postWebhook(ctx context.Context, url string, body []byte) (
+	*http.Response, error,
+) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (c *Client) logWebhook(url string, err error) {
+	if c.Logf != nil {
+		c.Logf("rest: webhook %s failed: %s", c.redact("URL", url), err)
+	}
+}
@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCreateReadyWebhook(t *testing.T) {
+	var payloads []WebhookPayload
+	var attempts = 0
+	var webhook = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts += 1
+			if attempts == 1 {
+				http.Error(w, "Unavailable", 503)
+				return
+			}
+			var payload WebhookPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Errorf("json.Decode errored %+v\n", err)
+			}
+			payloads = append(payloads, payload)
+		}))
+	defer webhook.Close()
+
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+		errorResponse(429, "Too many tunnels"),
+	})
+	defer server.Close()
+
+	var logs []string
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Logf: func(format string, v ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+		clock: &fakeClock{},
+	}
+	var request = Request{
+		DomainNames:  []string{"sauce-connect.proxy"},
+		ReadyWebhook: webhook.URL,
+	}
+
+	tunnel, err := client.CreateWithTimeout(&request, 0)
+	if err != nil {
+		t.Errorf("client.CreateWithTimeout errored %+v\n", err)
+	}
+	if _, err = client.CreateWithTimeout(&request, 0); err == nil {
+		t.Errorf("client.CreateWithTimeout didn't fail")
+	}
+
+	if len(payloads) != 2 ||
+		payloads[0].Event != "running" ||
+		payloads[0].Tunnel.Id != tunnel.Id ||
+		payloads[1].Event != "failed" ||
+		!strings.Contains(payloads[1].Error, "429") {
+		t.Errorf("Invalid payloads: %+v", payloads)
+	}
+
+	webhook.Close()
+	request.NoWait = true
+	if _, err = client.CreateWithTimeout(&request, 0); err == nil {
+		t.Errorf("client.CreateWithTimeout didn't fail")
+	}
+	var last = logs[len(logs)-1]
+	if !strings.Contains(last, "rest: webhook") {
+		t.Errorf("The webhook failure wasn't logged: %q", logs)
+	}
+}
+
+func TestClientCreateReadyWebhookCanceled(t *testing.T) {
+	var attempts = 0
+	var webhook = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts += 1
+		}))
+	defer webhook.Close()
+
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		clock:    &fakeClock{},
+	}
+	var request = Request{
+		DomainNames:  []string{"sauce-connect.proxy"},
+		ReadyWebhook: webhook.URL,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.create(&request, 0, WithContext(ctx)); err == nil {
+		t.Errorf("client.create didn't fail")
+	}
+	if attempts != 0 {
+		t.Errorf("The webhook was posted %d times after cancelation", attempts)
+	}
+}
+
+func TestClientCreateReadyWebhookNoAnswer(t *testing.T) {
+	defer func(timeout time.Duration) {
+		webhookTimeout = timeout
+	}(webhookTimeout)
+	webhookTimeout = 10 * time.Millisecond
+
+	var release = make(chan struct{})
+	var webhook = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	defer webhook.Close()
+	defer close(release)
+
+	var server = multiResponseServer([]R{
+		stringResponse(createJSON),
+		stringResponse(statusRunningJSON),
+	})
+	defer server.Close()
+
+	var logs []string
+	var client = Client{
+		BaseURL:  server.URL,
+		Username: "username",
+		Password: "password",
+		Logf: func(format string, v ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+		clock: &fakeClock{},
+	}
+	var request = Request{
+		DomainNames:  []string{"sauce-connect.proxy"},
+		ReadyWebhook: webhook.URL,
+	}
+
+	var done = make(chan error, 1)
+	go func() {
+		_, err := client.CreateWithTimeout(&request, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("client.CreateWithTimeout errored %+v\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client.CreateWithTimeout is stuck on the webhook")
+	}
+	if len(logs) == 0 || !strings.Contains(logs[len(logs)-1], "rest: webhook") {
+		t.Errorf("The webhook failure wasn't logged: %q", logs)
+	}
+}